@@ -0,0 +1,56 @@
+package graylog
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff describes how long to wait between successive attempts to
+// reach Graylog. Delays grow exponentially from Initial up to Max, and
+// are randomized by Jitter to avoid reconnection storms when many
+// processes lose the same server at once.
+type Backoff struct {
+	Initial    time.Duration // delay before the second attempt
+	Max        time.Duration // upper bound of a single delay
+	Multiplier float64       // growth factor between two delays
+	Jitter     float64       // randomization factor, between 0 and 1
+	Attempts   int           // attempts made before giving up, 0 means one
+}
+
+// DefaultBackoff is the backoff used by writers when none is configured.
+var DefaultBackoff = Backoff{
+	Initial:    100 * time.Millisecond,
+	Max:        10 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+	Attempts:   4,
+}
+
+// Delay returns the time to wait after the given number of consecutive
+// failed attempts.
+func (b Backoff) Delay(failures int) time.Duration {
+	if failures <= 0 || b.Initial <= 0 {
+		return 0
+	}
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	d := float64(b.Initial) * math.Pow(multiplier, float64(failures-1))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+func (b Backoff) attempts() int {
+	if b.Attempts <= 0 {
+		return 1
+	}
+	return b.Attempts
+}
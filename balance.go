@@ -0,0 +1,137 @@
+package graylog
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// BalancingWriter spreads messages across endpoints, in turn, or by the
+// value of HashField so that related messages, such as the messages of a
+// request, go to the same endpoint. An endpoint failing to take a message
+// is ejected for Cooldown, and the message is written to another one.
+// Ejected endpoints rejoin once their cooldown is over.
+type BalancingWriter struct {
+	endpointSet
+	next uint64 // round-robin counter, accessed atomically
+
+	// HashField, if set, is the extra field whose value selects the
+	// endpoint of a message, with or without its leading underscore.
+	// Messages without this field are balanced in turn.
+	HashField string
+	// Cooldown is how long a failing endpoint is ejected. Defaults to
+	// DefaultCooldown.
+	Cooldown time.Duration
+	// ErrorHandler, if set, is called with the messages that can't be
+	// written to any endpoint, in addition to the error being returned.
+	ErrorHandler ErrorHandler
+}
+
+// NewBalancingWriter returns a writer spreading messages across the
+// endpoints of addrs. Addresses are given as to NewWriter, and can mix
+// transports. opts apply to the writers of all the endpoints. An error is
+// returned when no endpoint can be reached.
+func NewBalancingWriter(addrs []string, opts ...WriterOption) (*BalancingWriter, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("graylog: no endpoint")
+	}
+	config := newWriterConfig(opts)
+	b := &BalancingWriter{
+		HashField: config.hashField,
+		Cooldown:  DefaultCooldown,
+	}
+	if config.cooldown > 0 {
+		b.Cooldown = config.cooldown
+	}
+	b.init(addrs, opts)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	reachable := false
+	for _, ep := range b.endpoints {
+		if _, eerr := b.writer(ep); eerr != nil {
+			b.markUnhealthy(ep, eerr, b.Cooldown)
+			err = eerr
+			continue
+		}
+		reachable = true
+	}
+	if !reachable {
+		return nil, err
+	}
+	return b, nil
+}
+
+// WriteMessage writes m to the endpoint selected for it, or to another
+// one if that endpoint fails.
+func (b *BalancingWriter) WriteMessage(m *Message) (err error) {
+	err = b.write(b.candidates(m), m, b.Cooldown)
+	b.stats.count(err)
+	if err != nil && b.ErrorHandler != nil {
+		b.ErrorHandler(err, m, b.Transport())
+	}
+	return err
+}
+
+// candidates returns the endpoints to try for m, in order.
+func (b *BalancingWriter) candidates(m *Message) []*endpoint {
+	b.mu.Lock()
+	healthy := b.healthy()
+	b.mu.Unlock()
+
+	candidates := make([]*endpoint, len(healthy))
+	if key, ok := b.hashKey(m); ok {
+		// Rendezvous hashing: ejecting an endpoint only moves the keys of
+		// this endpoint.
+		copy(candidates, healthy)
+		scores := make(map[*endpoint]uint64, len(candidates))
+		for _, ep := range candidates {
+			scores[ep] = rendezvousScore(key, ep.addr)
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return scores[candidates[i]] > scores[candidates[j]]
+		})
+		return candidates
+	}
+
+	start := int((atomic.AddUint64(&b.next, 1) - 1) % uint64(len(healthy)))
+	for i := range healthy {
+		candidates[i] = healthy[(start+i)%len(healthy)]
+	}
+	return candidates
+}
+
+// hashKey returns the value of the HashField of m, if any.
+func (b *BalancingWriter) hashKey(m *Message) (string, bool) {
+	if b.HashField == "" {
+		return "", false
+	}
+	v, ok := m.Extra[b.HashField]
+	if !ok && !strings.HasPrefix(b.HashField, "_") {
+		v, ok = m.Extra["_"+b.HashField]
+	}
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprint(v), true
+}
+
+func rendezvousScore(key, addr string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(addr))
+	return h.Sum64()
+}
+
+// Transport returns "balancing" followed by the address of the endpoint
+// the last message was written to, such as
+// "balancing(tcp://graylog-1:12201)".
+func (b *BalancingWriter) Transport() string {
+	return fmt.Sprintf("balancing(%s)", b.Active())
+}
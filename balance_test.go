@@ -0,0 +1,158 @@
+package graylog
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestServers(t *testing.T, n int) ([]*tcpServer, []string) {
+	var servers []*tcpServer
+	var addrs []string
+	for i := 0; i < n; i++ {
+		s := newTCPServer(t, "127.0.0.1:0")
+		servers = append(servers, s)
+		addrs = append(addrs, s.addr())
+	}
+	return servers, addrs
+}
+
+func TestBalancingRoundRobin(t *testing.T) {
+	servers, addrs := newTestServers(t, 3)
+	for _, s := range servers {
+		defer s.stop()
+	}
+
+	b, err := NewBalancingWriter(addrs)
+	if err != nil {
+		t.Fatalf("NewBalancingWriter: %s", err)
+	}
+	defer b.Close()
+
+	for i := 0; i < 6; i++ {
+		writeShorts(t, b, fmt.Sprint(i))
+	}
+	for i := 0; i < 6; i++ {
+		servers[i%3].expect(t, fmt.Sprint(i))
+	}
+	if stats := b.Stats(); stats.Messages != 6 || stats.Retries != 0 {
+		t.Errorf("expected 6 messages and no retry, got %+v", stats)
+	}
+}
+
+func TestBalancingHash(t *testing.T) {
+	servers, addrs := newTestServers(t, 3)
+	for _, s := range servers {
+		defer s.stop()
+	}
+
+	b, err := NewBalancingWriter(addrs, WithHashField("request_id"))
+	if err != nil {
+		t.Fatalf("NewBalancingWriter: %s", err)
+	}
+	defer b.Close()
+
+	// Write the messages of 20 requests, and record which endpoint got
+	// the ones of each request
+	endpoints := make(map[string]string)
+	used := make(map[string]bool)
+	for round := 0; round < 3; round++ {
+		for id := 0; id < 20; id++ {
+			key := fmt.Sprintf("req-%d", id)
+			m := &Message{Version: "1.1", Short: key, Extra: map[string]interface{}{"_request_id": key}}
+			if err := b.WriteMessage(m); err != nil {
+				t.Fatalf("WriteMessage: %s", err)
+			}
+			active := b.Active()
+			if previous, ok := endpoints[key]; ok && previous != active {
+				t.Errorf("%s: written to %s, then to %s", key, previous, active)
+			}
+			endpoints[key] = active
+			used[active] = true
+		}
+	}
+	if len(used) < 2 {
+		t.Errorf("expected the requests to be spread, got %v", used)
+	}
+
+	// Ejecting an endpoint doesn't move the other keys
+	b.mu.Lock()
+	b.markUnhealthy(b.endpoints[0], errWriteFailed, time.Hour)
+	b.mu.Unlock()
+	for id := 0; id < 20; id++ {
+		key := fmt.Sprintf("req-%d", id)
+		m := &Message{Version: "1.1", Short: key, Extra: map[string]interface{}{"_request_id": key}}
+		candidates := b.candidates(m)
+		if candidates[0] == b.endpoints[0] {
+			t.Errorf("%s: ejected endpoint selected", key)
+		}
+		if endpoints[key] != addrs[0] && candidates[0].addr != endpoints[key] {
+			t.Errorf("%s: moved from %s to %s", key, endpoints[key], candidates[0].addr)
+		}
+	}
+}
+
+func TestBalancingEjection(t *testing.T) {
+	servers, addrs := newTestServers(t, 2)
+	defer servers[1].stop()
+
+	b, err := NewBalancingWriter(addrs, WithCooldown(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewBalancingWriter: %s", err)
+	}
+	defer b.Close()
+
+	w := b.endpoints[0].w.(*LowLevelProtocolWriter)
+	w.Backoff = Backoff{}
+	servers[0].stop()
+	<-w.broken
+
+	for i := 0; i < 4; i++ {
+		writeShorts(t, b, fmt.Sprint(i))
+		servers[1].expect(t, fmt.Sprint(i))
+	}
+	if endpoints := b.Endpoints(); endpoints[0].Healthy || !endpoints[1].Healthy {
+		t.Errorf("expected the first endpoint to be ejected, got %+v", endpoints)
+	}
+
+	// The endpoint rejoins after the cooldown
+	servers[0] = newTCPServer(t, strings.TrimPrefix(addrs[0], "tcp://"))
+	defer servers[0].stop()
+	time.Sleep(150 * time.Millisecond)
+	for i := 4; i < 8; i++ {
+		writeShorts(t, b, fmt.Sprint(i))
+	}
+	select {
+	case <-servers[0].shorts:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the first endpoint to get messages again")
+	}
+}
+
+func TestBalancingHook(t *testing.T) {
+	servers, addrs := newTestServers(t, 2)
+	for _, s := range servers {
+		defer s.stop()
+	}
+
+	hook, err := New(addrs[0], WithBalancing(addrs[1]))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	defer hook.Close()
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Info("first")
+	log.Info("second")
+	servers[0].expect(t, "first")
+	servers[1].expect(t, "second")
+	if _, err := NewBalancingWriter([]string{unreachableAddr(t)}); err == nil {
+		t.Error("NewBalancingWriter should fail when no endpoint can be reached")
+	}
+}
@@ -0,0 +1,154 @@
+package graylog
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPendingLimit is the default PendingLimit of hooks.
+var DefaultPendingLimit = 1024
+
+// connect creates the writer of a hook which could not connect to
+// Graylog on creation. Attempts are spaced following DefaultBackoff, and
+// never stop until a writer is created or the hook is closed.
+func (hook *GraylogHook) connect(addr string) {
+	defer close(hook.connectDone)
+
+	for failures := 1; ; failures++ {
+		select {
+		case <-hook.quit:
+			return
+		case <-time.After(DefaultBackoff.Delay(failures)):
+		}
+
+		if hook.Writer() != nil {
+			// A writer was set in the meantime
+			return
+		}
+		w, err := hook.newWriter(addr)
+		if err != nil {
+			continue
+		}
+		hook.setWriter(w)
+		return
+	}
+}
+
+// newWriter creates the writer of a hook.
+func (hook *GraylogHook) newWriter(addr string) (GELFWriter, error) {
+	if len(hook.failover) > 0 {
+		return NewFailoverWriter(append([]string{addr}, hook.failover...), hook.writerOpts...)
+	}
+	if len(hook.balance) > 0 {
+		return NewBalancingWriter(append([]string{addr}, hook.balance...), hook.writerOpts...)
+	}
+	return NewWriter(addr, hook.writerOpts...)
+}
+
+// setWriter sets the hook writer, and writes the pending messages with it
+// before any new message.
+func (hook *GraylogHook) setWriter(w GELFWriter) {
+	type failure struct {
+		err error
+		m   *Message
+	}
+	var failures []failure
+
+	hook.watchWriter(w)
+	hook.connMu.Lock()
+	hook.gelfLogger = w
+	for _, m := range hook.pending {
+		if err := w.WriteMessage(m); err != nil {
+			failures = append(failures, failure{err, m})
+		}
+	}
+	hook.pending = nil
+	hook.connMu.Unlock()
+
+	// The error handler may log with this hook, so it must be called
+	// without holding connMu.
+	for _, f := range failures {
+		hook.lose(f.err, f.m)
+	}
+}
+
+// addPending keeps m until the hook is connected. If the hook got
+// connected in the meantime, m is not kept and the writer is returned
+// instead. The messages dropped to respect PendingLimit are returned.
+func (hook *GraylogHook) addPending(m *Message) (GELFWriter, []*Message) {
+	hook.connMu.Lock()
+	defer hook.connMu.Unlock()
+
+	if hook.gelfLogger != nil {
+		return hook.gelfLogger, nil
+	}
+
+	if hook.PendingLimit <= 0 {
+		return nil, []*Message{m}
+	}
+	var dropped []*Message
+	if len(hook.pending) >= hook.PendingLimit {
+		n := len(hook.pending) - hook.PendingLimit + 1
+		dropped = hook.pending[:n:n]
+		hook.pending = hook.pending[n:]
+	}
+	hook.pending = append(hook.pending, m)
+	return nil, dropped
+}
+
+// pendingLen returns the number of messages kept until the hook is
+// connected.
+func (hook *GraylogHook) pendingLen() int {
+	hook.connMu.RLock()
+	defer hook.connMu.RUnlock()
+
+	return len(hook.pending)
+}
+
+// losePending passes the messages kept until the hook is connected to
+// lose, once the hook is closed without having been connected.
+func (hook *GraylogHook) losePending() {
+	hook.connMu.Lock()
+	pending := hook.pending
+	hook.pending = nil
+	hook.connMu.Unlock()
+
+	for _, m := range pending {
+		atomic.AddUint64(&hook.stats.failed, 1)
+		hook.lose(ErrNotConnected, m)
+	}
+}
+
+// watchWriter passes the messages a writer fails to send in background,
+// such as batched HTTP messages, to lose.
+func (hook *GraylogHook) watchWriter(w GELFWriter) {
+	bw, ok := w.(interface {
+		setLostHandler(func(err error, m *Message))
+	})
+	if !ok {
+		return
+	}
+	bw.setLostHandler(func(err error, m *Message) {
+		atomic.AddUint64(&hook.stats.failed, 1)
+		hook.stats.countError(writerTransport(w))
+		hook.lose(err, m)
+	})
+}
+
+// flushWriter sends the messages buffered by the writer, if it buffers
+// any, or stops once ctx is done. Messages the writer can't send are passed
+// to the error handler, or spooled, and only a *FlushError reporting the
+// messages still buffered is returned.
+func (hook *GraylogHook) flushWriter(ctx context.Context) error {
+	f, ok := hook.Writer().(interface{ FlushContext(context.Context) error })
+	if !ok {
+		return nil
+	}
+	var flushErr *FlushError
+	if err := f.FlushContext(ctx); errors.As(err, &flushErr) {
+		return flushErr
+	}
+	return nil
+}
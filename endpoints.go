@@ -0,0 +1,267 @@
+package graylog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCooldown is how long a failing endpoint is left aside by
+// failover and balancing writers when no cooldown is configured.
+var DefaultCooldown = 30 * time.Second
+
+// endpoint is a Graylog address, and the writer sending to it once
+// created.
+type endpoint struct {
+	addr           string
+	w              GELFWriter
+	err            error     // last error
+	unhealthyUntil time.Time // zero while healthy
+}
+
+func (ep *endpoint) healthy(now time.Time) bool {
+	return !now.Before(ep.unhealthyUntil)
+}
+
+// EndpointStatus describes an endpoint of a failover or balancing writer.
+type EndpointStatus struct {
+	Addr    string
+	Active  bool      // last endpoint a message was written to
+	Healthy bool      // false during the cooldown following a failure
+	Until   time.Time // end of the cooldown of an unhealthy endpoint
+	Err     error     // last error of the endpoint
+}
+
+// endpointSet holds the endpoints shared by failover and balancing
+// writers, and writes messages to them.
+type endpointSet struct {
+	mu        sync.Mutex
+	endpoints []*endpoint
+	active    *endpoint
+	opts      []WriterOption
+	lost      func(err error, m *Message)
+	closed    bool
+	stats     writerCounters
+}
+
+func (s *endpointSet) init(addrs []string, opts []WriterOption) {
+	s.opts = opts
+	for _, addr := range addrs {
+		s.endpoints = append(s.endpoints, &endpoint{addr: addr})
+	}
+}
+
+// writer returns the writer of an endpoint, creating it if needed. s.mu
+// must be held.
+func (s *endpointSet) writer(ep *endpoint) (GELFWriter, error) {
+	if ep.w != nil {
+		return ep.w, nil
+	}
+	w, err := NewWriter(ep.addr, s.opts...)
+	if err != nil {
+		return nil, err
+	}
+	if s.lost != nil {
+		if lw, ok := w.(interface {
+			setLostHandler(func(err error, m *Message))
+		}); ok {
+			lw.setLostHandler(s.lost)
+		}
+	}
+	ep.w = w
+	return w, nil
+}
+
+// markUnhealthy leaves an endpoint aside for cooldown. s.mu must be held.
+func (s *endpointSet) markUnhealthy(ep *endpoint, err error, cooldown time.Duration) {
+	ep.err = err
+	ep.unhealthyUntil = time.Now().Add(cooldown)
+}
+
+// healthy returns the healthy endpoints, or all of them if none is
+// healthy so that messages are not dropped without trying. s.mu must be
+// held.
+func (s *endpointSet) healthy() []*endpoint {
+	now := time.Now()
+	var healthy []*endpoint
+	for _, ep := range s.endpoints {
+		if ep.healthy(now) {
+			healthy = append(healthy, ep)
+		}
+	}
+	if len(healthy) == 0 {
+		return s.endpoints
+	}
+	return healthy
+}
+
+// write writes m to the first of candidates which takes it. The
+// endpoints failing are left aside for cooldown.
+func (s *endpointSet) write(candidates []*endpoint, m *Message, cooldown time.Duration) error {
+	var lastErr error
+	for i, ep := range candidates {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return ErrClosed
+		}
+		w, err := s.writer(ep)
+		s.mu.Unlock()
+
+		if err == nil {
+			err = w.WriteMessage(m)
+		}
+
+		s.mu.Lock()
+		if err == nil {
+			ep.err = nil
+			ep.unhealthyUntil = time.Time{}
+			s.active = ep
+			s.mu.Unlock()
+			if i > 0 {
+				atomic.AddUint64(&s.stats.retries, 1)
+			}
+			return nil
+		}
+		s.markUnhealthy(ep, err, cooldown)
+		s.mu.Unlock()
+		lastErr = fmt.Errorf("%s: %w", ep.addr, err)
+	}
+	return lastErr
+}
+
+// Active returns the address of the endpoint the last message was
+// written to.
+func (s *endpointSet) Active() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil {
+		return ""
+	}
+	return s.active.addr
+}
+
+// Endpoints returns the status of the endpoints, in order.
+func (s *endpointSet) Endpoints() []EndpointStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	statuses := make([]EndpointStatus, len(s.endpoints))
+	for i, ep := range s.endpoints {
+		statuses[i] = EndpointStatus{
+			Addr:    ep.addr,
+			Active:  ep == s.active,
+			Healthy: ep.healthy(now),
+			Err:     ep.err,
+		}
+		if !statuses[i].Healthy {
+			statuses[i].Until = ep.unhealthyUntil
+		}
+	}
+	return statuses
+}
+
+// Stats returns a snapshot of the counters of the writer. Messages and
+// Errors count the messages written to any endpoint, or to none, and
+// Retries the messages written to another endpoint than the first one
+// tried. The other counters are the sums of the counters of the
+// endpoints.
+func (s *endpointSet) Stats() WriterStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.stats.snapshot()
+	for _, ep := range s.endpoints {
+		if w, ok := ep.w.(interface{ Stats() WriterStats }); ok {
+			es := w.Stats()
+			stats.Bytes += es.Bytes
+			stats.CompressedBytes += es.CompressedBytes
+			stats.Chunks += es.Chunks
+			stats.Retries += es.Retries
+			stats.Reconnects += es.Reconnects
+		}
+	}
+	return stats
+}
+
+// setLostHandler sets the function called with the messages the writers
+// of the endpoints fail to send in background.
+func (s *endpointSet) setLostHandler(lost func(err error, m *Message)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lost = lost
+	for _, ep := range s.endpoints {
+		if lw, ok := ep.w.(interface {
+			setLostHandler(func(err error, m *Message))
+		}); ok {
+			lw.setLostHandler(lost)
+		}
+	}
+}
+
+// writers returns the writers created for the endpoints.
+func (s *endpointSet) writers() []GELFWriter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ws []GELFWriter
+	for _, ep := range s.endpoints {
+		if ep.w != nil {
+			ws = append(ws, ep.w)
+		}
+	}
+	return ws
+}
+
+// Flush sends the messages buffered by the writers of the endpoints.
+func (s *endpointSet) Flush() error {
+	return s.FlushContext(context.Background())
+}
+
+// FlushContext sends the messages buffered by the writers of the
+// endpoints, or stops once ctx is done. In the latter case, a *FlushError
+// reports how many messages are still buffered.
+func (s *endpointSet) FlushContext(ctx context.Context) (err error) {
+	pending := 0
+	for _, w := range s.writers() {
+		fw, ok := w.(interface{ FlushContext(context.Context) error })
+		if !ok {
+			continue
+		}
+		ferr := fw.FlushContext(ctx)
+		var flushErr *FlushError
+		if errors.As(ferr, &flushErr) {
+			pending += flushErr.Pending
+		} else if ferr != nil {
+			err = ferr
+		}
+	}
+	if ctx.Err() != nil && pending > 0 {
+		return &FlushError{Pending: pending, Err: ctx.Err()}
+	}
+	return err
+}
+
+// Close closes the writers of the endpoints. Messages written after Close
+// fail with ErrClosed.
+func (s *endpointSet) Close() (err error) {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	for _, w := range s.writers() {
+		if c, ok := w.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
@@ -2,6 +2,9 @@ package graylog
 
 import (
 	"encoding/json"
+	"fmt"
+	"os"
+
 	"github.com/pkg/errors"
 )
 
@@ -45,3 +48,51 @@ func extractStackTrace(err error) errors.StackTrace {
 	}
 	return tracer.StackTrace()
 }
+
+// ErrNotConnected is passed to error handlers for the messages dropped
+// because a hook was not connected to Graylog yet, and already kept
+// PendingLimit messages or was closed.
+var ErrNotConnected = errors.New("graylog: not connected")
+
+// ErrQueueFull is passed to error handlers for the entries dropped because
+// the queue of an asynchronous hook was full.
+var ErrQueueFull = errors.New("graylog: queue is full")
+
+// ErrorHandler is called when a message can't be sent to Graylog.
+// transport is the name of the transport used, such as "udp", "tcp",
+// "tls", "unix", "unixgram" or "http". m is nil when the error isn't about
+// a given message.
+type ErrorHandler func(err error, m *Message, transport string)
+
+// DefaultErrorHandler writes errors to os.Stderr.
+func DefaultErrorHandler(err error, m *Message, transport string) {
+	if m == nil {
+		fmt.Fprintf(os.Stderr, "graylog: %s: %s\n", transport, err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "graylog: %s: can't send message %q: %s\n", transport, m.Short, err)
+}
+
+// MessageError is returned when a message can't be sent to Graylog.
+type MessageError struct {
+	Err     error
+	Message *Message
+}
+
+func (e *MessageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+// unwrapMessageError returns the error and the message of err if m is nil
+// and err is a *MessageError.
+func unwrapMessageError(err error, m *Message) (error, *Message) {
+	var msgErr *MessageError
+	if m == nil && errors.As(err, &msgErr) {
+		return msgErr.Err, msgErr.Message
+	}
+	return err, m
+}
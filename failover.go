@@ -0,0 +1,73 @@
+package graylog
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// FailoverWriter writes messages to the first healthy endpoint of an
+// ordered list. An endpoint failing to take a message is considered
+// unhealthy for Cooldown, and the message is written to the next one.
+// Endpoints are tried again, in order, once their cooldown is over, so
+// that messages go back to the first endpoint once it recovers.
+type FailoverWriter struct {
+	endpointSet
+
+	// Cooldown is how long a failing endpoint is left aside. Defaults to
+	// DefaultCooldown.
+	Cooldown time.Duration
+	// ErrorHandler, if set, is called with the messages that can't be
+	// written to any endpoint, in addition to the error being returned.
+	ErrorHandler ErrorHandler
+}
+
+// NewFailoverWriter returns a writer sending messages to the first healthy
+// endpoint of addrs. Addresses are given as to NewWriter, and can mix
+// transports. opts apply to the writers of all the endpoints. An error is
+// returned when no endpoint can be reached.
+func NewFailoverWriter(addrs []string, opts ...WriterOption) (*FailoverWriter, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("graylog: no endpoint")
+	}
+	config := newWriterConfig(opts)
+	f := &FailoverWriter{Cooldown: DefaultCooldown}
+	f.init(addrs, opts)
+	if config.cooldown > 0 {
+		f.Cooldown = config.cooldown
+	}
+
+	// Connect to the first endpoint which can be reached, so that
+	// unreachable clusters are reported early
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var err error
+	for _, ep := range f.endpoints {
+		if _, err = f.writer(ep); err == nil {
+			f.active = ep
+			return f, nil
+		}
+		f.markUnhealthy(ep, err, f.Cooldown)
+	}
+	return nil, err
+}
+
+// WriteMessage writes m to the first healthy endpoint which takes it.
+func (f *FailoverWriter) WriteMessage(m *Message) (err error) {
+	f.mu.Lock()
+	candidates := f.healthy()
+	f.mu.Unlock()
+
+	err = f.write(candidates, m, f.Cooldown)
+	f.stats.count(err)
+	if err != nil && f.ErrorHandler != nil {
+		f.ErrorHandler(err, m, f.Transport())
+	}
+	return err
+}
+
+// Transport returns "failover" followed by the address of the active
+// endpoint, such as "failover(tcp://graylog-1:12201)".
+func (f *FailoverWriter) Transport() string {
+	return fmt.Sprintf("failover(%s)", f.Active())
+}
@@ -0,0 +1,195 @@
+package graylog
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tcpServer is a GELF TCP server recording the messages it gets.
+type tcpServer struct {
+	net.Listener
+	shorts chan string
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTCPServer(t *testing.T, addr string) *tcpServer {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	s := &tcpServer{Listener: listener, shorts: make(chan string, 100)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go func() {
+				r := NewStreamReader(conn)
+				for {
+					msg, err := r.ReadMessage()
+					if err != nil {
+						return
+					}
+					s.shorts <- msg.Short
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *tcpServer) addr() string {
+	return "tcp://" + s.Addr().String()
+}
+
+// stop closes the listener and the connections of the server.
+func (s *tcpServer) stop() {
+	s.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *tcpServer) expect(t *testing.T, short string) {
+	t.Helper()
+	select {
+	case got := <-s.shorts:
+		if got != short {
+			t.Errorf("msg.Short: expected %s, got %s", short, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: expected %s", s.Addr(), short)
+	}
+}
+
+// unreachableAddr returns a TCP address nothing listens on.
+func unreachableAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	listener.Close()
+	return "tcp://" + listener.Addr().String()
+}
+
+func TestFailoverWriter(t *testing.T) {
+	primary := newTCPServer(t, "127.0.0.1:0")
+	secondary := newTCPServer(t, "127.0.0.1:0")
+	defer secondary.stop()
+
+	f, err := NewFailoverWriter([]string{primary.addr(), secondary.addr()}, WithCooldown(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewFailoverWriter: %s", err)
+	}
+	defer f.Close()
+
+	writeShorts(t, f, "first")
+	primary.expect(t, "first")
+	if active := f.Active(); active != primary.addr() {
+		t.Errorf("Active: expected %s, got %s", primary.addr(), active)
+	}
+
+	// Stop the primary endpoint, and wait for its writer to notice
+	w := f.endpoints[0].w.(*LowLevelProtocolWriter)
+	w.Backoff = Backoff{}
+	primary.stop()
+	<-w.broken
+
+	writeShorts(t, f, "second")
+	secondary.expect(t, "second")
+	if active := f.Active(); active != secondary.addr() {
+		t.Errorf("Active: expected %s, got %s", secondary.addr(), active)
+	}
+	if transport := f.Transport(); transport != "failover("+secondary.addr()+")" {
+		t.Errorf("Transport: unexpected %s", transport)
+	}
+	endpoints := f.Endpoints()
+	if endpoints[0].Healthy || endpoints[0].Err == nil || !endpoints[1].Healthy || !endpoints[1].Active {
+		t.Errorf("unexpected endpoints %+v", endpoints)
+	}
+	if stats := f.Stats(); stats.Messages != 2 || stats.Retries != 1 {
+		t.Errorf("expected 2 messages and 1 retry, got %+v", stats)
+	}
+
+	// During the cooldown, messages go to the secondary endpoint even if
+	// the primary one recovered
+	primary = newTCPServer(t, strings.TrimPrefix(primary.addr(), "tcp://"))
+	defer primary.stop()
+	writeShorts(t, f, "third")
+	secondary.expect(t, "third")
+
+	time.Sleep(150 * time.Millisecond)
+	writeShorts(t, f, "fourth")
+	primary.expect(t, "fourth")
+	if active := f.Active(); active != primary.addr() {
+		t.Errorf("Active: expected %s, got %s", primary.addr(), active)
+	}
+}
+
+func TestFailoverWriterErrors(t *testing.T) {
+	if _, err := NewFailoverWriter(nil); err == nil {
+		t.Error("NewFailoverWriter should fail without endpoints")
+	}
+	if _, err := NewFailoverWriter([]string{unreachableAddr(t), unreachableAddr(t)}); err == nil {
+		t.Error("NewFailoverWriter should fail when no endpoint can be reached")
+	}
+
+	server := newTCPServer(t, "127.0.0.1:0")
+	f, err := NewFailoverWriter([]string{server.addr()})
+	if err != nil {
+		t.Fatalf("NewFailoverWriter: %s", err)
+	}
+	w := f.endpoints[0].w.(*LowLevelProtocolWriter)
+	w.Backoff = Backoff{}
+	server.stop()
+	<-w.broken
+
+	// Unhealthy endpoints are tried when none is healthy
+	for i := 0; i < 2; i++ {
+		if err := f.WriteMessage(&Message{Version: "1.1", Short: "lost"}); err == nil {
+			t.Error("WriteMessage should fail")
+		}
+	}
+	if stats := f.Stats(); stats.Errors != 2 {
+		t.Errorf("expected 2 errors, got %d", stats.Errors)
+	}
+
+	f.Close()
+	if err := f.WriteMessage(&Message{Version: "1.1", Short: "closed"}); err != ErrClosed {
+		t.Errorf("WriteMessage: expected ErrClosed, got %v", err)
+	}
+}
+
+func TestFailoverHook(t *testing.T) {
+	server := newTCPServer(t, "127.0.0.1:0")
+	defer server.stop()
+
+	hook, err := New(unreachableAddr(t), WithFailover(server.addr()))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	defer hook.Close()
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Info("failed over")
+	server.expect(t, "failed over")
+	if active := hook.Writer().(*FailoverWriter).Active(); active != server.addr() {
+		t.Errorf("Active: expected %s, got %s", server.addr(), active)
+	}
+}
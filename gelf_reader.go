@@ -1,6 +1,7 @@
 package graylog
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
@@ -13,8 +14,13 @@ import (
 )
 
 type Reader struct {
-	mu   sync.Mutex
-	conn net.Conn
+	mu     sync.Mutex
+	conn   net.Conn
+	stream *bufio.Reader
+
+	// ChunkSize is the size of the largest datagram read, it must be at
+	// least the chunk size of the writers. Defaults to ChunkSize.
+	ChunkSize int
 }
 
 func NewUDPReader(addr string) (*Reader, error) {
@@ -49,6 +55,16 @@ func NewTCPReader(addr string) (*net.TCPListener, error) {
 	return listener, nil
 }
 
+// NewStreamReader returns a Reader for a stream-oriented connection,
+// such as one accepted on the listener returned by NewTCPReader. Messages
+// are expected to be uncompressed and terminated by a null byte.
+func NewStreamReader(conn net.Conn) *Reader {
+	r := new(Reader)
+	r.conn = conn
+	r.stream = bufio.NewReader(conn)
+	return r
+}
+
 func (r *Reader) Addr() string {
 	return r.conn.LocalAddr().String()
 }
@@ -73,7 +89,15 @@ func (r *Reader) Read(p []byte) (int, error) {
 }
 
 func (r *Reader) ReadMessage() (*Message, error) {
-	cBuf := make([]byte, ChunkSize)
+	if r.stream != nil {
+		return r.readFramedMessage()
+	}
+
+	chunkSize := r.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = ChunkSize
+	}
+	cBuf := make([]byte, chunkSize)
 	var (
 		err        error
 		n, length  int
@@ -86,7 +110,9 @@ func (r *Reader) ReadMessage() (*Message, error) {
 	)
 
 	for got := 0; got < 128 && (total == 0 || got < int(total)); got++ {
-		if n, err = r.conn.Read(cBuf); err != nil {
+		// cBuf was resliced to the previous datagram, read the next one
+		// with the full capacity
+		if n, err = r.conn.Read(cBuf[:cap(cBuf)]); err != nil {
 			return nil, fmt.Errorf("Read: %s", err)
 		}
 		cHead, cBuf = cBuf[:2], cBuf[:n]
@@ -97,7 +123,7 @@ func (r *Reader) ReadMessage() (*Message, error) {
 			if ocid != nil && !bytes.Equal(cid, ocid) {
 				return nil, fmt.Errorf("out-of-band message %v (awaited %v)", cid, ocid)
 			} else if ocid == nil {
-				ocid = cid
+				ocid = append([]byte(nil), cid...)
 				chunks = make([][]byte, total)
 			}
 			n = len(cBuf) - chunkedHeaderLen
@@ -151,3 +177,22 @@ func (r *Reader) ReadMessage() (*Message, error) {
 
 	return msg, nil
 }
+
+// readFramedMessage reads a single null-terminated message from a
+// stream connection.
+func (r *Reader) readFramedMessage() (*Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	frame, err := r.stream.ReadBytes(0)
+	if err != nil {
+		return nil, fmt.Errorf("Read: %s", err)
+	}
+
+	msg := new(Message)
+	if err := json.Unmarshal(frame[:len(frame)-1], &msg); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %s", err)
+	}
+
+	return msg, nil
+}
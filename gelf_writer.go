@@ -9,8 +9,11 @@ import (
 	"compress/flate"
 	"compress/gzip"
 	"compress/zlib"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -19,6 +22,7 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,22 +30,97 @@ type GELFWriter interface {
 	WriteMessage(m *Message) (err error)
 }
 
+// writerTransport returns the name of the transport of a writer, if it
+// has a Transport method.
+func writerTransport(w GELFWriter) string {
+	if t, ok := w.(interface{ Transport() string }); ok {
+		return t.Transport()
+	}
+	return fmt.Sprintf("%T", w)
+}
+
+// addrTransport returns the name of the transport selected by the scheme
+// of an address given to NewWriter.
+func addrTransport(addr string) string {
+	switch {
+	case strings.HasPrefix(addr, "http"):
+		return "http"
+	case strings.HasPrefix(addr, "tcp://"):
+		return "tcp"
+	case strings.HasPrefix(addr, "tls://"):
+		return "tls"
+	case strings.HasPrefix(addr, "unix://"):
+		return "unix"
+	case strings.HasPrefix(addr, "unixgram://"):
+		return "unixgram"
+	default:
+		return "udp"
+	}
+}
+
 // LowLevelProtocolWriter implements io.Writer and is used to send both discrete
 // messages to a graylog2 server, or data from a stream-oriented
 // interface (like the functions in log).
 type LowLevelProtocolWriter struct {
 	mu               sync.Mutex
 	conn             net.Conn
+	protocol         string
+	addr             string
+	tlsConfig        *tls.Config
 	hostname         string
 	Facility         string // defaults to current process name
 	CompressionLevel int    // one of the consts from compress/flate
 	CompressionType  CompressType
+	ChunkSize        int // size of the UDP datagrams, defaults to ChunkSize
+	Truncation       TruncatePolicy
+
+	// Backoff controls how stream connections are redialed once they
+	// are found broken. Defaults to DefaultBackoff.
+	Backoff Backoff
+	// WriteTimeout bounds the time taken to write a message, and to redial
+	// broken connections. Stream connections timing out are redialed.
+	// Defaults to DefaultWriteTimeout, 0 means no limit.
+	WriteTimeout time.Duration
+	// OnReconnect, if set, is called after every redial attempt.
+	OnReconnect func(ReconnectEvent)
+	// ErrorHandler, if set, is called with the messages that can't be
+	// written, in addition to the error being returned.
+	ErrorHandler ErrorHandler
+
+	done     chan struct{} // closed by Close
+	closing  sync.Once
+	broken   chan struct{} // closed once the peer closed the connection
+	stats    writerCounters
+	failures int       // consecutive failed redials
+	nextDial time.Time // no redial will be attempted before this time
+
+	dialer             net.Dialer
+	resolveInterval    time.Duration // UDP addresses are resolved again at this interval
+	resolveAfterErrors int           // or after this many consecutive failed writes
+	writeErrors        int           // consecutive failed writes
+	resolving          int32         // set while resolving
 
 	zw                 writerCloserResetter
 	zwCompressionLevel int
 	zwCompressionType  CompressType
 }
 
+// Default timeouts of the writers of stream and datagram connections, see
+// WithDialTimeout and WithWriteTimeout.
+var (
+	DefaultDialTimeout  = 10 * time.Second
+	DefaultWriteTimeout = 10 * time.Second
+)
+
+// ReconnectEvent describes an attempt made by a writer to reestablish
+// its connection to the GELF server.
+type ReconnectEvent struct {
+	Network string
+	Addr    string
+	Attempt int   // consecutive attempt number, starting at 1
+	Err     error // nil when the connection was reestablished
+}
+
 // What compression type the writer should use when sending messages
 // to the graylog2 server
 type CompressType int
@@ -69,14 +148,22 @@ type Message struct {
 
 type innerMessage Message //against circular (Un)MarshalJSON
 
+// gelfTimestamp returns t as seconds since the UNIX epoch, truncated to
+// the given precision.
+func gelfTimestamp(t time.Time, precision time.Duration) float64 {
+	return float64(t.UnixNano()/int64(precision)) / float64(time.Second/precision)
+}
+
 // Used to control GELF chunking.  Should be less than (MTU - len(UDP
-// header)).
-//
-// TODO: generate dynamically using Path MTU Discovery?
+// header)). ChunkSizeWAN fits the usual 1500 bytes MTU, ChunkSizeLAN fits
+// jumbo frames. The chunk size of a writer is set with WithChunkSize.
 const (
-	ChunkSize        = 1420
+	ChunkSizeWAN     = 1420
+	ChunkSizeLAN     = 8154
+	ChunkSize        = ChunkSizeWAN // default chunk size
 	chunkedHeaderLen = 12
-	chunkedDataLen   = ChunkSize - chunkedHeaderLen
+	maxChunkSize     = 65507 // maximum payload of a UDP datagram
+	maxChunks        = 128   // maximum number of chunks accepted by Graylog
 )
 
 var (
@@ -85,48 +172,131 @@ var (
 	magicGzip    = []byte{0x1f, 0x8b}
 )
 
-// numChunks returns the number of GELF chunks necessary to transmit
-// the given compressed buffer.
-func numChunks(b []byte) int {
+// numChunks returns the number of GELF chunks of chunkSize bytes
+// necessary to transmit the given compressed buffer.
+func numChunks(b []byte, chunkSize int) int {
 	lenB := len(b)
-	if lenB <= ChunkSize {
+	if lenB <= chunkSize {
 		return 1
 	}
-	return len(b)/chunkedDataLen + 1
+	dataLen := chunkSize - chunkedHeaderLen
+	return (lenB + dataLen - 1) / dataLen
 }
 
 // NewWriter returns a new GELFWriter. This writer can be used to send the
 // output of the standard Go log functions to a central GELF server by
 // passing it to log.SetOutput()
-func NewWriter(addr string) (GELFWriter, error) {
+//
+// The transport is selected by the scheme of addr: "http://" and
+// "https://" for GELF HTTP, "tcp://" for GELF TCP, "tls://" for GELF TCP
+// over TLS, "unix://" and "unixgram://" followed by the path of a Unix
+// socket for GELF TCP and GELF UDP over Unix sockets, and UDP when addr
+// has no scheme.
+func NewWriter(addr string, opts ...WriterOption) (GELFWriter, error) {
+	config := newWriterConfig(opts)
+
 	if strings.HasPrefix(addr, "http") {
-		return newHTTPWriter(addr)
+		return newHTTPWriter(addr, config)
 	}
 	if strings.HasPrefix(addr, "tcp://") {
-		return newLowLevelProtocolWriter("tcp", strings.TrimPrefix(addr, "tcp://"))
+		return newLowLevelProtocolWriter("tcp", strings.TrimPrefix(addr, "tcp://"), config)
+	}
+	if strings.HasPrefix(addr, "tls://") {
+		return newLowLevelProtocolWriter("tls", strings.TrimPrefix(addr, "tls://"), config)
+	}
+	if strings.HasPrefix(addr, "unix://") {
+		return newLowLevelProtocolWriter("unix", strings.TrimPrefix(addr, "unix://"), config)
+	}
+	if strings.HasPrefix(addr, "unixgram://") {
+		return newLowLevelProtocolWriter("unixgram", strings.TrimPrefix(addr, "unixgram://"), config)
 	}
 
-	return newLowLevelProtocolWriter("udp", addr)
+	return newLowLevelProtocolWriter("udp", addr, config)
 }
 
-func newHTTPWriter(addr string) (GELFWriter, error) {
-	httpClient := &http.Client{
-		Transport: &http.Transport{},
-		Timeout:   10 * time.Second,
+func newHTTPWriter(addr string, config *writerConfig) (GELFWriter, error) {
+	httpClient := config.httpClient
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           config.proxy,
+				TLSClientConfig: config.tlsConfig,
+			},
+			Timeout: 10 * time.Second,
+		}
+	}
+	if config.roundTripper != nil || config.httpTimeoutSet {
+		// Don't modify a client given by the caller
+		c := *httpClient
+		httpClient = &c
+	}
+	if config.roundTripper != nil {
+		httpClient.Transport = config.roundTripper
+	}
+	if config.httpTimeoutSet {
+		httpClient.Timeout = config.httpTimeout
 	}
 
-	return HTTPWriter{
-		httpClient: httpClient,
-		addr:       addr,
-	}, nil
+	w := &HTTPWriter{
+		httpClient:       httpClient,
+		ownClient:        config.httpClient == nil && config.roundTripper == nil,
+		addr:             addr,
+		Header:           config.httpHeader,
+		HeaderFunc:       config.httpHeaderFunc,
+		CompressionType:  NoCompress,
+		CompressionLevel: flate.BestSpeed,
+		Backoff:          DefaultBackoff,
+		done:             make(chan struct{}),
+	}
+	if config.compression != nil {
+		w.CompressionType = config.compression.compressionType
+		w.CompressionLevel = config.compression.level
+	}
+	if config.batch != nil {
+		w.startBatching(*config.batch)
+	}
+	return w, nil
 }
 
-func newLowLevelProtocolWriter(protocol, addr string) (GELFWriter, error) {
+func newLowLevelProtocolWriter(protocol, addr string, config *writerConfig) (GELFWriter, error) {
 	var err error
 	w := new(LowLevelProtocolWriter)
+	w.protocol = protocol
+	w.addr = addr
+	w.tlsConfig = config.tlsConfig
+	if protocol == "tls" && w.tlsConfig == nil {
+		w.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
 	w.CompressionLevel = flate.BestSpeed
+	if config.compression != nil {
+		w.CompressionType = config.compression.compressionType
+		w.CompressionLevel = config.compression.level
+	}
+	w.Truncation = config.truncation
+	w.ChunkSize = ChunkSize
+	if config.chunkSize != 0 {
+		if config.chunkSize <= chunkedHeaderLen || config.chunkSize > maxChunkSize {
+			return nil, fmt.Errorf("invalid chunk size %d", config.chunkSize)
+		}
+		w.ChunkSize = config.chunkSize
+	}
+	w.Backoff = DefaultBackoff
+	w.WriteTimeout = DefaultWriteTimeout
+	if config.writeTimeoutSet {
+		w.WriteTimeout = config.writeTimeout
+	}
+	w.dialer.Timeout = DefaultDialTimeout
+	if config.dialTimeoutSet {
+		w.dialer.Timeout = config.dialTimeout
+	}
+	w.dialer.KeepAlive = config.keepAlive
+	w.dialer.Resolver = config.resolver
+	w.done = make(chan struct{})
+
+	w.resolveInterval = config.resolveInterval
+	w.resolveAfterErrors = config.resolveAfterErrors
 
-	if w.conn, err = net.Dial(protocol, strings.TrimPrefix(addr, "tcp://")); err != nil {
+	if err = w.connect(time.Time{}); err != nil {
 		return nil, err
 	}
 
@@ -136,6 +306,10 @@ func newLowLevelProtocolWriter(protocol, addr string) (GELFWriter, error) {
 
 	w.Facility = path.Base(os.Args[0])
 
+	if w.protocol == "udp" && w.resolveInterval > 0 {
+		go w.resolveLoop()
+	}
+
 	return w, nil
 }
 
@@ -146,10 +320,12 @@ func newLowLevelProtocolWriter(protocol, addr string) (GELFWriter, error) {
 //	2-byte magic (0x1e 0x0f), 8 byte id, 1 byte sequence id, 1 byte
 //	total, chunk-data
 func (w *LowLevelProtocolWriter) writeChunked(zBytes []byte) (err error) {
-	b := make([]byte, 0, ChunkSize)
+	chunkSize := w.chunkSize()
+	chunkedDataLen := chunkSize - chunkedHeaderLen
+	b := make([]byte, 0, chunkSize)
 	buf := bytes.NewBuffer(b)
-	nChunksI := numChunks(zBytes)
-	if nChunksI > 255 {
+	nChunksI := numChunks(zBytes, chunkSize)
+	if nChunksI > maxChunks {
 		return fmt.Errorf("msg too large, would need %d chunks", nChunksI)
 	}
 	nChunks := uint8(nChunksI)
@@ -191,6 +367,7 @@ func (w *LowLevelProtocolWriter) writeChunked(zBytes []byte) (err error) {
 		}
 
 		bytesLeft -= chunkLen
+		atomic.AddUint64(&w.stats.chunks, 1)
 	}
 
 	if bytesLeft != 0 {
@@ -199,6 +376,185 @@ func (w *LowLevelProtocolWriter) writeChunked(zBytes []byte) (err error) {
 	return nil
 }
 
+// connect dials the GELF server, giving up at deadline if it is not zero.
+// For stream protocols, the connection is watched in the background so
+// that a connection closed by the server is noticed before the next
+// message is lost writing to it.
+func (w *LowLevelProtocolWriter) connect(deadline time.Time) error {
+	conn, err := w.dialDeadline(deadline)
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+
+	if w.isStream() {
+		broken := make(chan struct{})
+		w.broken = broken
+		go watchConn(conn, broken)
+	}
+	return nil
+}
+
+func (w *LowLevelProtocolWriter) dial() (net.Conn, error) {
+	return w.dialDeadline(time.Time{})
+}
+
+// dialDeadline dials the GELF server, giving up at deadline if it is not
+// zero, or after the dial timeout.
+func (w *LowLevelProtocolWriter) dialDeadline(deadline time.Time) (net.Conn, error) {
+	dialer := w.dialer
+	dialer.Deadline = deadline
+	if w.protocol == "tls" {
+		return tls.DialWithDialer(&dialer, "tcp", w.addr, w.tlsConfig)
+	}
+	return dialer.Dial(w.protocol, w.addr)
+}
+
+// setWriteDeadline bounds the time the next writes can take, so that a
+// connection which stopped being read, such as a half-open TCP
+// connection, fails instead of blocking the writer.
+func (w *LowLevelProtocolWriter) setWriteDeadline() error {
+	if w.WriteTimeout <= 0 {
+		return nil
+	}
+	return w.conn.SetWriteDeadline(time.Now().Add(w.WriteTimeout))
+}
+
+// watchConn reads from conn until it fails, then closes broken. GELF
+// servers never send anything back, so this only returns once the
+// connection was closed by either side.
+func watchConn(conn net.Conn, broken chan struct{}) {
+	io.Copy(io.Discard, conn)
+	close(broken)
+}
+
+// isBroken reports whether the current connection is known to be unusable.
+func (w *LowLevelProtocolWriter) isBroken() bool {
+	if w.conn == nil {
+		return true
+	}
+	select {
+	case <-w.broken:
+		return true
+	default:
+		return false
+	}
+}
+
+// reconnect closes the current connection and redials the server,
+// waiting between attempts as configured by w.Backoff. As w.mu is held
+// meanwhile, blocking every logging goroutine, the attempts stop once
+// WriteTimeout has elapsed. Once all attempts failed, further calls return
+// immediately with an error until the next backoff delay has elapsed.
+func (w *LowLevelProtocolWriter) reconnect() error {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+
+	if wait := time.Until(w.nextDial); wait > 0 {
+		return fmt.Errorf("not connected to %s, next attempt in %s", w.addr, wait)
+	}
+
+	var deadline time.Time
+	if w.WriteTimeout > 0 {
+		deadline = time.Now().Add(w.WriteTimeout)
+	}
+	var err error
+	for i := 0; i < w.Backoff.attempts(); i++ {
+		if i > 0 {
+			delay := w.Backoff.Delay(w.failures)
+			if !deadline.IsZero() && time.Until(deadline) <= delay {
+				break
+			}
+			select {
+			case <-w.done:
+				return ErrClosed
+			case <-time.After(delay):
+			}
+		}
+		err = w.connect(deadline)
+		w.notifyReconnect(err)
+		if err == nil {
+			atomic.AddUint64(&w.stats.reconnects, 1)
+			w.failures = 0
+			w.nextDial = time.Time{}
+			return nil
+		}
+		w.failures++
+	}
+	w.nextDial = time.Now().Add(w.Backoff.Delay(w.failures))
+	return err
+}
+
+func (w *LowLevelProtocolWriter) notifyReconnect(err error) {
+	if w.OnReconnect == nil {
+		return
+	}
+	w.OnReconnect(ReconnectEvent{
+		Network: w.protocol,
+		Addr:    w.addr,
+		Attempt: w.failures + 1,
+		Err:     err,
+	})
+}
+
+func (w *LowLevelProtocolWriter) chunkSize() int {
+	if w.ChunkSize <= chunkedHeaderLen || w.ChunkSize > maxChunkSize {
+		return ChunkSize
+	}
+	return w.ChunkSize
+}
+
+// isStream reports whether the writer is connected through a
+// stream-oriented protocol, where GELF messages are framed instead of
+// chunked.
+func (w *LowLevelProtocolWriter) isStream() bool {
+	return w.protocol == "tcp" || w.protocol == "tls" || w.protocol == "unix"
+}
+
+// writeFramed writes the uncompressed message to the connection,
+// terminated by a null byte as required by GELF TCP inputs. Compression
+// and chunking are not supported by the GELF stream framing.
+// If the connection is broken, it is reestablished and the message is
+// written again.
+func (w *LowLevelProtocolWriter) writeFramed(mBytes []byte) error {
+	frame := make([]byte, 0, len(mBytes)+1)
+	frame = append(frame, mBytes...)
+	frame = append(frame, 0)
+
+	if w.isBroken() {
+		if err := w.reconnect(); err != nil {
+			return err
+		}
+	}
+
+	err := w.writeFrame(frame)
+	if err == nil {
+		return nil
+	}
+	if rerr := w.reconnect(); rerr != nil {
+		return fmt.Errorf("%s (reconnect: %s)", err, rerr)
+	}
+	atomic.AddUint64(&w.stats.retries, 1)
+	return w.writeFrame(frame)
+}
+
+func (w *LowLevelProtocolWriter) writeFrame(frame []byte) error {
+	if err := w.setWriteDeadline(); err != nil {
+		return err
+	}
+	n, err := w.conn.Write(frame)
+	atomic.AddUint64(&w.stats.compressedBytes, uint64(n))
+	if err != nil {
+		return err
+	}
+	if n != len(frame) {
+		return fmt.Errorf("bad write (%d/%d)", n, len(frame))
+	}
+	return nil
+}
+
 type bufferedWriter struct {
 	buffer io.Writer
 }
@@ -225,15 +581,127 @@ type writerCloserResetter interface {
 // filled out appropriately. In general, clients will want to use
 // Write, rather than WriteMessage.
 func (w *LowLevelProtocolWriter) WriteMessage(m *Message) (err error) {
+	err = w.writeMessage(m)
+	w.stats.count(err)
+	if err != nil && w.ErrorHandler != nil {
+		w.ErrorHandler(err, m, w.protocol)
+	}
+	return err
+}
+
+// Stats returns a snapshot of the counters of the writer.
+func (w *LowLevelProtocolWriter) Stats() WriterStats {
+	return w.stats.snapshot()
+}
+
+// Transport returns the name of the protocol used by the writer.
+func (w *LowLevelProtocolWriter) Transport() string {
+	return w.protocol
+}
+
+func (w *LowLevelProtocolWriter) writeMessage(m *Message) (err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
+	if w.isClosed() {
+		return ErrClosed
+	}
+
 	mBytes, err := json.Marshal(m)
 	if err != nil {
 		return
 	}
+	atomic.AddUint64(&w.stats.bytes, uint64(len(mBytes)))
+
+	if w.isStream() {
+		return w.writeFramed(mBytes)
+	}
+
+	zBytes, err := w.compress(mBytes)
+	if err != nil {
+		return
+	}
+	if numChunks(zBytes, w.chunkSize()) > maxChunks && w.Truncation == TruncateMessage {
+		if zBytes, err = w.truncate(m, mBytes, zBytes); err != nil {
+			return
+		}
+	}
+	atomic.AddUint64(&w.stats.compressedBytes, uint64(len(zBytes)))
+
+	if w.protocol != "unixgram" {
+		err = w.writeDatagrams(zBytes)
+		w.observeWrite(err)
+		return
+	}
+
+	// The socket of a local relay is recreated when it restarts, which
+	// breaks the connection until it is redialed.
+	if w.conn == nil {
+		if err = w.reconnect(); err != nil {
+			return
+		}
+	}
+	if err = w.writeDatagrams(zBytes); err == nil {
+		return nil
+	}
+	if rerr := w.reconnect(); rerr != nil {
+		return fmt.Errorf("%s (reconnect: %s)", err, rerr)
+	}
+	atomic.AddUint64(&w.stats.retries, 1)
+	return w.writeDatagrams(zBytes)
+}
+
+// writeDatagrams writes the compressed message in a single datagram, or
+// chunked if it doesn't fit.
+func (w *LowLevelProtocolWriter) writeDatagrams(zBytes []byte) error {
+	if err := w.setWriteDeadline(); err != nil {
+		return err
+	}
+	if numChunks(zBytes, w.chunkSize()) > 1 {
+		return w.writeChunked(zBytes)
+	}
+
+	n, err := w.conn.Write(zBytes)
+	if err != nil {
+		return err
+	}
+	if n != len(zBytes) {
+		return fmt.Errorf("bad write (%d/%d)", n, len(zBytes))
+	}
+
+	return nil
+}
+
+// Close closes the connection to the GELF server. Messages written after
+// Close fail with ErrClosed.
+func (w *LowLevelProtocolWriter) Close() error {
+	w.closing.Do(func() { close(w.done) })
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+func (w *LowLevelProtocolWriter) isClosed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// compress compresses an encoded message with the compression settings of
+// the writer.
+func (w *LowLevelProtocolWriter) compress(mBytes []byte) ([]byte, error) {
 	var zBuf bytes.Buffer
+	var err error
 
 	// . If compression settings have changed, a new writer is required.
 	if w.zwCompressionType != w.CompressionType || w.zwCompressionLevel != w.CompressionLevel {
@@ -257,35 +725,23 @@ func (w *LowLevelProtocolWriter) WriteMessage(m *Message) (err error) {
 	}
 
 	if err != nil {
-		return
+		return nil, err
 	}
+	w.zwCompressionType = w.CompressionType
+	w.zwCompressionLevel = w.CompressionLevel
 
 	w.zw.Reset(&zBuf)
 
 	if _, err = w.zw.Write(mBytes); err != nil {
-		return
+		return nil, err
 	}
 	w.zw.Close()
 
-	zBytes := zBuf.Bytes()
-	if numChunks(zBytes) > 1 {
-		return w.writeChunked(zBytes)
-	}
-
-	n, err := w.conn.Write(zBytes)
-	if err != nil {
-		return
-	}
-	if n != len(zBytes) {
-		return fmt.Errorf("bad write (%d/%d)", n, len(zBytes))
-	}
-
-	return nil
+	return zBuf.Bytes(), nil
 }
 
 /*
 func (w *Writer) Alert(m string) (err error)
-func (w *Writer) Close() error
 func (w *Writer) Crit(m string) (err error)
 func (w *Writer) Debug(m string) (err error)
 func (w *Writer) Emerg(m string) (err error)
@@ -318,7 +774,7 @@ func (w *LowLevelProtocolWriter) Write(p []byte) (n int, err error) {
 		Host:     w.hostname,
 		Short:    string(short),
 		Full:     string(full),
-		TimeUnix: float64(time.Now().UnixNano()/1000000) / 1000.,
+		TimeUnix: gelfTimestamp(time.Now(), time.Millisecond),
 		Level:    6, // info
 		Facility: w.Facility,
 		Extra:    map[string]interface{}{},
@@ -396,24 +852,211 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 // as an io.Writer
 type HTTPWriter struct {
 	httpClient *http.Client
+	ownClient  bool // the client was created by the writer, see Close
 	addr       string
+	closed     int32
+	done       chan struct{} // closed by Close, interrupts retries
+	closing    sync.Once
+	stats      writerCounters
+	batch      *httpBatch // nil unless batching
+
+	// CompressionType selects the Content-Encoding of the requests:
+	// gzip, deflate (zlib) or none, the default.
+	CompressionType  CompressType
+	CompressionLevel int // one of the consts from compress/flate
+
+	// Backoff controls how failed requests are retried: requests are
+	// retried on transient transport errors, 5xx and 429 statuses, waiting at least
+	// the Retry-After delay sent by the server. Backoff.Attempts is the
+	// retry budget of each message. Defaults to DefaultBackoff.
+	Backoff Backoff
+
+	// Header is added to every request, see WithHTTPHeader.
+	Header http.Header
+	// HeaderFunc, if set, is called with the headers of every request,
+	// see WithHTTPHeaderFunc.
+	HeaderFunc func(http.Header) error
+
+	// ErrorHandler, if set, is called with the messages that can't be
+	// written, in addition to the error being returned.
+	ErrorHandler ErrorHandler
 }
 
-func (h HTTPWriter) WriteMessage(m *Message) (err error) {
+func (h *HTTPWriter) WriteMessage(m *Message) (err error) {
+	if h.batching() {
+		err = h.addToBatch(m)
+	} else {
+		err = h.writeMessage(m)
+	}
+	if err != nil {
+		h.report(err, m)
+	}
+	return err
+}
+
+// report accounts for a message sent, or not, and passes the error to
+// the ErrorHandler.
+func (h *HTTPWriter) report(err error, m *Message) {
+	h.stats.count(err)
+	if err != nil && h.ErrorHandler != nil {
+		h.ErrorHandler(err, m, h.Transport())
+	}
+}
+
+// Stats returns a snapshot of the counters of the writer.
+func (h *HTTPWriter) Stats() WriterStats {
+	return h.stats.snapshot()
+}
+
+// Transport returns "http".
+func (h *HTTPWriter) Transport() string {
+	return "http"
+}
+
+func (h *HTTPWriter) writeMessage(m *Message) (err error) {
+	if atomic.LoadInt32(&h.closed) != 0 {
+		return ErrClosed
+	}
+
 	mBytes, err := json.Marshal(m)
 	if err != nil {
 		return
 	}
+	atomic.AddUint64(&h.stats.bytes, uint64(len(mBytes)))
 
-	resp, err := h.httpClient.Post(h.addr, "application/json", bytes.NewBuffer(mBytes))
+	body, encoding, err := h.compress(mBytes)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&h.stats.compressedBytes, uint64(len(body)))
+
+	return h.send(context.Background(), body, encoding)
+}
+
+// send posts body, retrying as long as the errors are retryable and the
+// Backoff allows it, and ctx is not done.
+func (h *HTTPWriter) send(ctx context.Context, body []byte, encoding string) error {
+	attempts := h.Backoff.attempts()
+	for attempt := 1; ; attempt++ {
+		err := h.post(ctx, body, encoding)
+		if err == nil {
+			return nil
+		}
+		if attempt > 1 {
+			err = &RetryError{Attempts: attempt, Err: err}
+		}
+		if !isRetryable(err) || attempt >= attempts || ctx.Err() != nil {
+			return err
+		}
+
+		delay := h.Backoff.Delay(attempt)
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) && httpErr.RetryAfter > delay {
+			if h.Backoff.Max > 0 && httpErr.RetryAfter > h.Backoff.Max {
+				// Waiting that long would block the logger
+				return err
+			}
+			delay = httpErr.RetryAfter
+		}
+
+		atomic.AddUint64(&h.stats.retries, 1)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-h.done:
+			timer.Stop()
+			return err
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// post sends body in a single request.
+func (h *HTTPWriter) post(ctx context.Context, body []byte, encoding string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.addr, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, values := range h.Header {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	if h.HeaderFunc != nil {
+		if err := h.HeaderFunc(req.Header); err != nil {
+			return err
+		}
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	resp, err := h.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	// Drain the body so that the connection can be reused
+	io.Copy(io.Discard, resp.Body)
 
-	if resp.StatusCode != 202 {
-		return fmt.Errorf("got code %s, expected 202", resp.Status)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &HTTPError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
 	}
 
 	return nil
 }
+
+// compress returns the body of a request sending mBytes, and its
+// Content-Encoding.
+func (h *HTTPWriter) compress(mBytes []byte) ([]byte, string, error) {
+	var zBuf bytes.Buffer
+	var zw io.WriteCloser
+	var encoding string
+	var err error
+
+	switch h.CompressionType {
+	case CompressGzip:
+		zw, err = gzip.NewWriterLevel(&zBuf, h.CompressionLevel)
+		encoding = "gzip"
+	case CompressZlib:
+		// The "deflate" content coding is the zlib format, RFC 9110 8.4.1.2
+		zw, err = zlib.NewWriterLevel(&zBuf, h.CompressionLevel)
+		encoding = "deflate"
+	case NoCompress:
+		return mBytes, "", nil
+	default:
+		return nil, "", fmt.Errorf("unknown compression type %d", h.CompressionType)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if _, err = zw.Write(mBytes); err != nil {
+		return nil, "", err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, "", err
+	}
+	return zBuf.Bytes(), encoding, nil
+}
+
+// Close sends the batched messages, if any, and releases the idle
+// connections of the writer, unless its client or transport was given by
+// WithHTTPClient or WithRoundTripper. Messages written after Close fail
+// with ErrClosed.
+func (h *HTTPWriter) Close() (err error) {
+	if h.batch != nil {
+		err = h.stopBatching()
+	}
+	atomic.StoreInt32(&h.closed, 1)
+	h.closing.Do(func() { close(h.done) })
+	if h.ownClient {
+		h.httpClient.CloseIdleConnections()
+	}
+	return err
+}
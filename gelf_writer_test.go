@@ -0,0 +1,816 @@
+package graylog
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTCPFraming(t *testing.T) {
+	listener, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer listener.Close()
+
+	frames := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Errorf("Accept: %s", err)
+			close(frames)
+			return
+		}
+		defer conn.Close()
+		frame, err := bufio.NewReader(conn).ReadBytes(0)
+		if err != nil {
+			t.Errorf("ReadBytes: %s", err)
+		}
+		frames <- frame
+	}()
+
+	w, err := NewWriter("tcp://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	// Large enough to need several chunks over UDP
+	full := strings.Repeat("x", 10*ChunkSize)
+	if err := w.WriteMessage(&Message{Version: "1.1", Host: "testing.local", Short: "short", Full: full}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+
+	frame := <-frames
+	if len(frame) == 0 || frame[len(frame)-1] != 0 {
+		t.Fatalf("frame should be terminated by a null byte")
+	}
+	if frame[0] != '{' {
+		t.Errorf("frame should be uncompressed JSON, got magic %x", frame[:2])
+	}
+
+	var msg Message
+	if err := json.Unmarshal(frame[:len(frame)-1], &msg); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	if msg.Full != full {
+		t.Errorf("msg.Full: expected %d bytes, got %d", len(full), len(msg.Full))
+	}
+}
+
+func TestTCPReconnect(t *testing.T) {
+	listener, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer listener.Close()
+
+	shorts := make(chan string)
+	go func() {
+		// Read a single message per connection, then close it like a
+		// restarting server would.
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			msg, err := NewStreamReader(conn).ReadMessage()
+			if err != nil {
+				t.Errorf("ReadMessage: %s", err)
+			}
+			conn.Close()
+			shorts <- msg.Short
+		}
+	}()
+
+	g, err := NewWriter("tcp://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w := g.(*LowLevelProtocolWriter)
+	var events []ReconnectEvent
+	w.OnReconnect = func(e ReconnectEvent) {
+		events = append(events, e)
+	}
+
+	for _, short := range []string{"first", "second"} {
+		if err := w.WriteMessage(&Message{Version: "1.1", Host: "testing.local", Short: short}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+		if got := <-shorts; got != short {
+			t.Errorf("msg.Short: expected %s, got %s", short, got)
+		}
+		// Wait for the writer to notice the connection was closed
+		<-w.broken
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("expected 1 reconnect event, got %d", len(events))
+	}
+	if events[0].Err != nil || events[0].Attempt != 1 {
+		t.Errorf("unexpected reconnect event %+v", events[0])
+	}
+}
+
+func TestTCPReconnectFailure(t *testing.T) {
+	listener, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	g, err := NewWriter("tcp://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w := g.(*LowLevelProtocolWriter)
+	w.Backoff = Backoff{Initial: time.Millisecond, Max: time.Hour, Multiplier: 2, Attempts: 3}
+	attempts := 0
+	w.OnReconnect = func(e ReconnectEvent) {
+		attempts++
+		if e.Err == nil {
+			t.Errorf("reconnect should fail")
+		}
+	}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	listener.Close()
+	conn.Close()
+	<-w.broken
+
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "lost"}); err == nil {
+		t.Error("WriteMessage should fail when the server is gone")
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 reconnect attempts, got %d", attempts)
+	}
+
+	// The next attempt is delayed, so the writer must fail fast
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "lost"}); err == nil {
+		t.Error("WriteMessage should fail when the server is gone")
+	}
+	if attempts != 3 {
+		t.Errorf("expected no new reconnect attempt, got %d", attempts)
+	}
+}
+
+func TestTCPReconnectWriteTimeout(t *testing.T) {
+	listener, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	g, err := NewWriter("tcp://"+listener.Addr().String(), WithWriteTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w := g.(*LowLevelProtocolWriter)
+	defer w.Close()
+	w.Backoff = Backoff{Initial: time.Second, Multiplier: 2, Attempts: 4}
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	listener.Close()
+	conn.Close()
+	<-w.broken
+
+	// Waiting for the next attempts would exceed the write timeout
+	start := time.Now()
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "lost"}); err == nil {
+		t.Error("WriteMessage should fail when the server is gone")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("reconnecting should stop after the write timeout, took %s", elapsed)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+	expected := []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+	for failures, d := range expected {
+		if got := b.Delay(failures); got != d {
+			t.Errorf("Delay(%d): expected %s, got %s", failures, d, got)
+		}
+	}
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := b.Delay(3); got < 200*time.Millisecond || got > 600*time.Millisecond {
+			t.Fatalf("Delay(3) with jitter out of bounds: %s", got)
+		}
+	}
+}
+
+// testPKI holds a throwaway CA and the certificates it signed.
+type testPKI struct {
+	pool   *x509.CertPool
+	server tls.Certificate
+	client tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey: %s", err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatalf("CreateCertificate: %s", err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return &testPKI{
+		pool:   pool,
+		server: issue(2, "graylog.test", x509.ExtKeyUsageServerAuth),
+		client: issue(3, "client.test", x509.ExtKeyUsageClientAuth),
+	}
+}
+
+func TestWritingToTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{pki.server},
+		ClientCAs:    pki.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("tls.Listen: %s", err)
+	}
+	defer listener.Close()
+
+	shorts := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg, err := NewStreamReader(conn).ReadMessage()
+		if err != nil {
+			// The handshake of rejected clients fails here
+			shorts <- ""
+			return
+		}
+		shorts <- msg.Short
+	}()
+
+	// Without the server name override, the certificate doesn't match
+	// the 127.0.0.1 address.
+	if _, err := NewWriter("tls://"+listener.Addr().String(), WithTLSConfig(&tls.Config{RootCAs: pki.pool})); err == nil {
+		t.Fatal("NewWriter should fail to verify the server certificate")
+	}
+	<-shorts
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg, err := NewStreamReader(conn).ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			shorts <- ""
+			return
+		}
+		shorts <- msg.Short
+	}()
+
+	w, err := NewWriter("tls://"+listener.Addr().String(), WithTLSConfig(&tls.Config{
+		RootCAs:      pki.pool,
+		Certificates: []tls.Certificate{pki.client},
+		ServerName:   "graylog.test",
+		MinVersion:   tls.VersionTLS13,
+	}))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	if err := w.WriteMessage(&Message{Version: "1.1", Host: "testing.local", Short: "over tls"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if got := <-shorts; got != "over tls" {
+		t.Errorf("msg.Short: expected %s, got %s", "over tls", got)
+	}
+}
+
+func TestHTTPWriterClose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	w, err := NewWriter(server.URL)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "before close"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "after close"}); err != ErrClosed {
+		t.Errorf("WriteMessage: expected ErrClosed, got %v", err)
+	}
+}
+
+func TestWriterErrorHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	w, err := NewWriter(server.URL)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	var handled int
+	w.(*HTTPWriter).ErrorHandler = func(err error, m *Message, transport string) {
+		handled++
+		if m.Short != "rejected" || transport != "http" {
+			t.Errorf("unexpected error handler arguments %s, %s", m.Short, transport)
+		}
+	}
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "rejected"}); err == nil {
+		t.Error("WriteMessage should fail")
+	}
+	if handled != 1 {
+		t.Errorf("expected the error handler to be called once, got %d", handled)
+	}
+}
+
+func TestHTTPWriterStatus(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusAccepted, http.StatusNoContent, http.StatusMultipleChoices, http.StatusInternalServerError} {
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(status)
+		}))
+
+		w, err := NewWriter(server.URL)
+		if err != nil {
+			t.Fatalf("NewWriter: %s", err)
+		}
+		err = w.WriteMessage(&Message{Version: "1.1", Short: "status"})
+		if success := status >= 200 && status <= 299; success != (err == nil) {
+			t.Errorf("status %d: unexpected WriteMessage error %v", status, err)
+		}
+		server.Close()
+	}
+}
+
+func TestHTTPWriterCompression(t *testing.T) {
+	tests := []struct {
+		compressionType CompressType
+		encoding        string
+	}{
+		{NoCompress, ""},
+		{CompressGzip, "gzip"},
+		{CompressZlib, "deflate"},
+	}
+
+	for _, test := range tests {
+		var encoding, short string
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			encoding = req.Header.Get("Content-Encoding")
+			var body io.Reader = req.Body
+			switch encoding {
+			case "gzip":
+				zr, err := gzip.NewReader(req.Body)
+				if err != nil {
+					t.Errorf("gzip.NewReader: %s", err)
+					return
+				}
+				body = zr
+			case "deflate":
+				zr, err := zlib.NewReader(req.Body)
+				if err != nil {
+					t.Errorf("zlib.NewReader: %s", err)
+					return
+				}
+				body = zr
+			}
+			var m Message
+			if err := json.NewDecoder(body).Decode(&m); err != nil {
+				t.Errorf("Decode: %s", err)
+			}
+			short = m.Short
+			rw.WriteHeader(http.StatusAccepted)
+		}))
+
+		w, err := NewWriter(server.URL)
+		if err != nil {
+			t.Fatalf("NewWriter: %s", err)
+		}
+		if w.(*HTTPWriter).CompressionType != NoCompress {
+			t.Error("HTTP writers should not compress by default")
+		}
+		w.(*HTTPWriter).CompressionType = test.compressionType
+		w.(*HTTPWriter).CompressionLevel = flate.BestCompression
+		if err := w.WriteMessage(&Message{Version: "1.1", Short: "compressed"}); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+		}
+		if encoding != test.encoding {
+			t.Errorf("Content-Encoding: expected %q, got %q", test.encoding, encoding)
+		}
+		if short != "compressed" {
+			t.Errorf("msg.Short: expected %s, got %s", "compressed", short)
+		}
+		server.Close()
+	}
+}
+
+// countingTransport counts the requests it sends, and the calls to
+// CloseIdleConnections.
+type countingTransport struct {
+	requests   int
+	closeCalls int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (c *countingTransport) CloseIdleConnections() {
+	c.closeCalls++
+}
+
+func TestHTTPWriterOptions(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		headers <- req.Header
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	transport := new(countingTransport)
+	token := 0
+	w, err := NewWriter(server.URL,
+		WithHTTPHeader("X-Static", "a"),
+		WithHTTPHeader("X-Static", "b"),
+		WithBasicAuth("user", "secret"),
+		WithHTTPHeaderFunc(func(header http.Header) error {
+			token++
+			header.Set("X-Token", fmt.Sprint(token))
+			return nil
+		}),
+		WithRoundTripper(transport),
+		WithHTTPTimeout(time.Second),
+	)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		if err := w.WriteMessage(&Message{Version: "1.1", Short: "with headers"}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+		header := <-headers
+		if got := header.Values("X-Static"); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+			t.Errorf("X-Static: expected [a b], got %v", got)
+		}
+		if got := header.Get("X-Token"); got != fmt.Sprint(i) {
+			t.Errorf("X-Token: expected %d, got %s", i, got)
+		}
+		req := &http.Request{Header: header}
+		if user, password, ok := req.BasicAuth(); !ok || user != "user" || password != "secret" {
+			t.Errorf("BasicAuth: expected user:secret, got %s:%s", user, password)
+		}
+	}
+	if transport.requests != 2 {
+		t.Errorf("expected 2 requests through the round tripper, got %d", transport.requests)
+	}
+	if timeout := w.(*HTTPWriter).httpClient.Timeout; timeout != time.Second {
+		t.Errorf("expected a 1s timeout, got %s", timeout)
+	}
+
+	// Header functions can fail requests
+	w.(*HTTPWriter).HeaderFunc = func(http.Header) error {
+		return errWriteFailed
+	}
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "no token"}); err != errWriteFailed {
+		t.Errorf("WriteMessage: expected %v, got %v", errWriteFailed, err)
+	}
+}
+
+func TestHTTPWriterClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if got := req.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("Authorization: expected %s, got %s", "Bearer token", got)
+		}
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	transport := new(countingTransport)
+	client := &http.Client{Transport: transport}
+	w, err := NewWriter(server.URL, WithHTTPClient(client), WithBearerToken("token"), WithHTTPTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "with client"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if transport.requests != 1 {
+		t.Errorf("expected the request to be sent by the client, got %d requests", transport.requests)
+	}
+	if client.Timeout != 0 {
+		t.Error("the client given to WithHTTPClient should not be modified")
+	}
+	w.(*HTTPWriter).Close()
+	if transport.closeCalls != 0 {
+		t.Error("Close should not close the idle connections of the client given to WithHTTPClient")
+	}
+}
+
+func TestChunkSize(t *testing.T) {
+	// Random data doesn't compress well
+	random := make([]byte, 4*ChunkSizeLAN)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("rand.Read: %s", err)
+	}
+	full := hex.EncodeToString(random)
+
+	for _, chunkSize := range []int{576, ChunkSizeWAN, ChunkSizeLAN} {
+		r, err := NewUDPReader("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("NewUDPReader: %s", err)
+		}
+		r.ChunkSize = chunkSize
+
+		w, err := NewWriter(r.Addr(), WithChunkSize(chunkSize))
+		if err != nil {
+			t.Fatalf("NewWriter: %s", err)
+		}
+		if err := w.WriteMessage(&Message{Version: "1.1", Short: "chunked", Full: full}); err != nil {
+			t.Fatalf("chunk size %d: WriteMessage: %s", chunkSize, err)
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("chunk size %d: ReadMessage: %s", chunkSize, err)
+		}
+		if msg.Full != full {
+			t.Errorf("chunk size %d: msg.Full doesn't match", chunkSize)
+		}
+
+		stats := w.(*LowLevelProtocolWriter).Stats()
+		expected := numChunks(make([]byte, stats.CompressedBytes), chunkSize)
+		if stats.Chunks != uint64(expected) {
+			t.Errorf("chunk size %d: expected %d chunks, got %d", chunkSize, expected, stats.Chunks)
+		}
+	}
+
+	if _, err := NewWriter("127.0.0.1:12201", WithChunkSize(chunkedHeaderLen)); err == nil {
+		t.Error("NewWriter should reject chunks without room for data")
+	}
+}
+
+func TestNumChunks(t *testing.T) {
+	dataLen := ChunkSize - chunkedHeaderLen
+	tests := map[int]int{
+		1:             1,
+		ChunkSize:     1,
+		ChunkSize + 1: 2,
+		2 * dataLen:   2,
+		2*dataLen + 1: 3,
+	}
+	for size, expected := range tests {
+		if got := numChunks(make([]byte, size), ChunkSize); got != expected {
+			t.Errorf("numChunks(%d): expected %d, got %d", size, expected, got)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets are not supported")
+	}
+	path := filepath.Join(t.TempDir(), "gelf.sock")
+
+	shorts := make(chan string)
+	conns := make(chan net.Conn, 1)
+	listen := func() net.Listener {
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatalf("Listen: %s", err)
+		}
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			r := NewStreamReader(conn)
+			for {
+				msg, err := r.ReadMessage()
+				if err != nil {
+					return
+				}
+				shorts <- msg.Short
+			}
+		}()
+		return listener
+	}
+
+	listener := listen()
+	g, err := NewWriter("unix://" + path)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w := g.(*LowLevelProtocolWriter)
+	defer w.Close()
+	if transport := w.Transport(); transport != "unix" {
+		t.Errorf("Transport: expected unix, got %s", transport)
+	}
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "first"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if got := <-shorts; got != "first" {
+		t.Errorf("msg.Short: expected first, got %s", got)
+	}
+
+	// Restart the relay, recreating its socket
+	listener.Close()
+	(<-conns).Close()
+	os.Remove(path)
+	<-w.broken
+	listener = listen()
+	defer listener.Close()
+	defer func() {
+		select {
+		case conn := <-conns:
+			conn.Close()
+		default:
+		}
+	}()
+
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "second"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if got := <-shorts; got != "second" {
+		t.Errorf("msg.Short: expected second, got %s", got)
+	}
+}
+
+func TestUnixgramSocket(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "darwin" {
+		t.Skip("Unix datagram sockets are not supported")
+	}
+	path := filepath.Join(t.TempDir(), "gelf.sock")
+
+	listen := func() *Reader {
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		if err != nil {
+			t.Fatalf("ListenUnixgram: %s", err)
+		}
+		return &Reader{conn: conn, ChunkSize: 200}
+	}
+
+	r := listen()
+	w, err := NewWriter("unixgram://"+path, WithChunkSize(200))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.(io.Closer).Close()
+
+	// Large enough to be chunked
+	full := randomString(t, 1000)
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "first", Full: full}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "first" || msg.Full != full {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	if chunks := w.(*LowLevelProtocolWriter).Stats().Chunks; chunks <= 1 {
+		t.Errorf("expected the message to be chunked, got %d chunks", chunks)
+	}
+
+	// Restart the relay, recreating its socket
+	r.conn.Close()
+	os.Remove(path)
+	r = listen()
+	defer r.conn.Close()
+
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "second"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if msg, err = r.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "second" {
+		t.Errorf("msg.Short: expected second, got %s", msg.Short)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// A server which accepts connections and never reads from them, like
+	// the peer of a half-open connection
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	defer func() {
+		for len(accepted) > 0 {
+			(<-accepted).Close()
+		}
+	}()
+
+	g, err := NewWriter("tcp://"+listener.Addr().String(),
+		WithWriteTimeout(50*time.Millisecond), WithDialTimeout(time.Second), WithKeepAlive(-1))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w := g.(*LowLevelProtocolWriter)
+	defer w.Close()
+	w.Backoff = Backoff{}
+	if w.dialer.Timeout != time.Second || w.dialer.KeepAlive != -1 {
+		t.Errorf("unexpected dialer %+v", w.dialer)
+	}
+
+	// A message larger than the socket buffers can't be written, on the
+	// first connection nor on the next one
+	full := randomString(t, 32<<20)
+	start := time.Now()
+	err = w.WriteMessage(&Message{Version: "1.1", Short: "blocked", Full: full})
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("WriteMessage: expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("WriteMessage took %s", elapsed)
+	}
+	if reconnects := w.Stats().Reconnects; reconnects == 0 {
+		t.Error("expected the writer to reconnect after a timeout")
+	}
+}
@@ -2,11 +2,14 @@ package graylog
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -14,24 +17,69 @@ import (
 
 const StackTraceKey = "_stacktrace"
 
-// Set graylog.BufSize = <value> _before_ calling NewGraylogHook
+// Set graylog.BufSize = <value> _before_ calling NewAsyncGraylogHook
 // Once the buffer is full, logging will start blocking, waiting for slots to
 // be available in the queue.
+// Use NewAsyncGraylogHookWithQueue to configure the queue of a single hook.
 var BufSize uint = 8192
 
 // GraylogHook to send logs to a logging service compatible with the Graylog API and the GELF format.
 type GraylogHook struct {
 	Extra       map[string]interface{}
 	Host        string
+	Facility    string
 	Level       logrus.Level
 	gelfLogger  GELFWriter
-	buf         chan graylogEntry
+	lanes       []*lane // most severe first
+	laneConfig  []Lane
+	queue       QueueConfig
 	wg          sync.WaitGroup
+	queued      int64         // entries fired but not sent yet, accessed atomically
+	dropped     uint64        // entries dropped by the overflow policy, accessed atomically
+	drainMu     sync.Mutex    // guards drained
+	drained     chan struct{} // closed and replaced when queued drops to zero
 	mu          sync.RWMutex
 	synchronous bool
 	blacklist   map[string]bool
+
+	// PendingLimit is the maximum number of messages kept while the hook
+	// is not connected to Graylog yet. Older messages are dropped first.
+	PendingLimit int
+
+	writerOpts []WriterOption
+	failover   []string // addresses following the one given to New
+	balance    []string // addresses balanced with the one given to New
+	lazy       bool
+	connMu     sync.RWMutex // guards gelfLogger and pending
+	pending    []*Message
+	transport  string // transport selected by the address, until connected
+
+	// ErrorHandler is called with the messages that can't be sent to
+	// Graylog. Defaults to DefaultErrorHandler.
+	ErrorHandler ErrorHandler
+	// ReturnErrors makes Fire return the errors of synchronous hooks,
+	// instead of passing them to ErrorHandler.
+	ReturnErrors bool
+
+	// TimestampPrecision is the precision of the GELF timestamps, such as
+	// time.Millisecond (the default) or time.Microsecond.
+	TimestampPrecision time.Duration
+	// Clock returns the time of the entries without one. Defaults to
+	// time.Now.
+	Clock func() time.Time
+
+	closed      int32         // set by Close, accessed atomically
+	quit        chan struct{} // closed by Close to stop background goroutines
+	fireDone    chan struct{} // closed once the fire goroutine returned
+	connectDone chan struct{} // closed once the connect goroutine returned
+	spool       *spool
+	spoolDone   chan struct{} // closed once the spool goroutine returned
+	stats       hookCounters
 }
 
+// ErrClosed is returned when using a hook or a writer after it was closed.
+var ErrClosed = errors.New("graylog: use of closed hook or writer")
+
 // Graylog needs file and line params
 type graylogEntry struct {
 	*logrus.Entry
@@ -40,61 +88,114 @@ type graylogEntry struct {
 }
 
 // NewGraylogHook creates a hook to be added to an instance of logger.
+// If Graylog can't be reached yet, the hook keeps trying to connect in the
+// background and buffers up to PendingLimit messages in the meantime.
 func NewGraylogHook(addr string, extra map[string]interface{}) *GraylogHook {
-	g, err := NewWriter(addr)
+	opts := []Option{WithExtra(extra), WithLazyConnect()}
+	return newHook(addr, opts, opts)
+}
+
+// NewAsyncGraylogHook creates a hook to be added to an instance of logger.
+// The hook created will be asynchronous, and it's the responsibility of the user to call the Flush method
+// before exiting to empty the log queue.
+func NewAsyncGraylogHook(addr string, extra map[string]interface{}) *GraylogHook {
+	return NewAsyncGraylogHookWithQueue(addr, extra, QueueConfig{Size: BufSize})
+}
+
+// NewAsyncGraylogHookWithQueue creates an asynchronous hook like
+// NewAsyncGraylogHook, with the given queue size and overflow policy.
+// Invalid settings are reported to DefaultErrorHandler and replaced:
+// unknown overflow policies block, and OverflowBlockTimeout without
+// timeout drops the newest entry.
+func NewAsyncGraylogHookWithQueue(addr string, extra map[string]interface{}, queue QueueConfig) *GraylogHook {
+	return newHook(addr,
+		[]Option{WithExtra(extra), WithQueue(queue), WithLazyConnect()},
+		[]Option{WithExtra(extra), WithQueue(queue.withDefaults()), WithLazyConnect()})
+}
+
+// newHook creates a hook with New for the constructors which can't return
+// errors. If New fails, the error is passed to DefaultErrorHandler and the
+// hook is created with the fallback options, which can't fail.
+func newHook(addr string, opts, fallback []Option) *GraylogHook {
+	hook, err := New(addr, opts...)
 	if err != nil {
-		logrus.WithError(err).Error("Can't create Gelf logger")
+		DefaultErrorHandler(err, nil, addrTransport(addr))
+		hook, _ = New(addr, fallback...)
 	}
+	return hook
+}
 
+// New creates a hook to be added to an instance of logger, configured by
+// opts. The hook is synchronous, unless WithAsync or WithQueue is given.
+// An error is returned when an option is invalid, or when the writer can't
+// be created and WithLazyConnect is not given.
+func New(addr string, opts ...Option) (*GraylogHook, error) {
 	host, err := os.Hostname()
 	if err != nil {
 		host = "localhost"
 	}
 
 	hook := &GraylogHook{
-		Host:        host,
-		Extra:       extra,
-		Level:       logrus.DebugLevel,
-		gelfLogger:  g,
-		synchronous: true,
+		Host:         host,
+		Level:        logrus.DebugLevel,
+		PendingLimit: DefaultPendingLimit,
+		ErrorHandler: DefaultErrorHandler,
+		Clock:        time.Now,
+		synchronous:  true,
+		transport:    addrTransport(addr),
+		quit:         make(chan struct{}),
+		drained:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(hook); err != nil {
+			return nil, err
+		}
 	}
 
-	return hook
-}
-
-// NewAsyncGraylogHook creates a hook to be added to an instance of logger.
-// The hook created will be asynchronous, and it's the responsibility of the user to call the Flush method
-// before exiting to empty the log queue.
-func NewAsyncGraylogHook(addr string, extra map[string]interface{}) *GraylogHook {
-	g, err := NewWriter(addr)
+	g, err := hook.newWriter(addr)
 	if err != nil {
-		logrus.WithError(err).Error("Can't create Gelf logger")
+		if !hook.lazy {
+			return nil, err
+		}
+		hook.handleError(fmt.Errorf("can't create Gelf logger, will retry in background: %w", err), nil)
+		hook.connectDone = make(chan struct{})
+		go hook.connect(addr)
+	} else {
+		hook.watchWriter(g)
+		hook.gelfLogger = g
 	}
 
-	host, err := os.Hostname()
-	if err != nil {
-		host = "localhost"
+	if hook.spool != nil {
+		hook.spoolDone = make(chan struct{})
+		go hook.spoolLoop()
 	}
 
-	hook := &GraylogHook{
-		Host:       host,
-		Extra:      extra,
-		Level:      logrus.DebugLevel,
-		gelfLogger: g,
-		buf:        make(chan graylogEntry, BufSize),
+	if !hook.synchronous {
+		hook.lanes = hook.newLanes()
+		hook.fireDone = make(chan struct{})
+		go hook.fire() // Log in background
 	}
-	go hook.fire() // Log in background
 
-	return hook
+	return hook, nil
 }
 
 // Fire is called when a log event is fired.
 // We assume the entry will be altered by another hook,
 // otherwise we might be logging something wrong to Graylog
 func (hook *GraylogHook) Fire(entry *logrus.Entry) error {
+	// Checked before claiming the mutex, so that the entries logged by the
+	// error handler while Close sends the queue don't wait for it.
+	if atomic.LoadInt32(&hook.closed) != 0 {
+		return ErrClosed
+	}
 	hook.mu.RLock() // Claim the mutex as a RLock - allowing multiple go routines to log simultaneously
 	defer hook.mu.RUnlock()
 
+	if atomic.LoadInt32(&hook.closed) != 0 {
+		return ErrClosed
+	}
+	atomic.AddUint64(&hook.stats.fired, 1)
+
 	var file string
 	var line int
 
@@ -107,6 +208,12 @@ func (hook *GraylogHook) Fire(entry *logrus.Entry) error {
 	for k, v := range entry.Data {
 		switch v := v.(type) {
 		case error:
+			if k == logrus.ErrorKey {
+				// Keep the error itself so its stack trace can be
+				// extracted, it will be marshaled by sendEntry
+				newData[k] = v
+				continue
+			}
 			// Otherwise errors are ignored by `encoding/json`
 			// https://github.com/Sirupsen/logrus/issues/137
 			newData[k] = v.Error()
@@ -126,10 +233,14 @@ func (hook *GraylogHook) Fire(entry *logrus.Entry) error {
 	gEntry := graylogEntry{newEntry, file, line}
 
 	if hook.synchronous {
-		hook.sendEntry(gEntry)
+		if err := hook.sendEntry(gEntry); err != nil {
+			if hook.ReturnErrors {
+				return err
+			}
+			hook.lose(err, nil)
+		}
 	} else {
-		hook.wg.Add(1)
-		hook.buf <- gEntry
+		hook.enqueue(gEntry)
 	}
 
 	return nil
@@ -138,19 +249,174 @@ func (hook *GraylogHook) Fire(entry *logrus.Entry) error {
 // Flush waits for the log queue to be empty.
 // This func is meant to be used when the hook was created with NewAsyncGraylogHook.
 func (hook *GraylogHook) Flush() {
-	hook.mu.Lock() // claim the mutex as a Lock - we want exclusive access to it
-	defer hook.mu.Unlock()
+	hook.FlushContext(context.Background())
+}
 
+// FlushError is returned by FlushContext when the context is done before
+// the log queue is empty, or before the messages batched by the writer
+// are sent.
+type FlushError struct {
+	Pending int   // number of entries not sent yet
+	Err     error // error of the context
+}
+
+func (e *FlushError) Error() string {
+	return fmt.Sprintf("graylog: %d entries still pending: %s", e.Pending, e.Err)
+}
+
+func (e *FlushError) Unwrap() error {
+	return e.Err
+}
+
+// FlushContext waits for the log queue to be empty, or for ctx to be done.
+// In the latter case, a *FlushError reports how many entries were still
+// pending, including the messages kept while the hook is not connected.
+// Entries are not discarded, and will still be sent in background.
+// FlushContext doesn't wait for the hook to connect: the messages kept
+// until then are passed to the error handler, or spooled, by Close.
+// This func is meant to be used when the hook was created with NewAsyncGraylogHook.
+func (hook *GraylogHook) FlushContext(ctx context.Context) error {
+	if err := hook.waitQueue(ctx); err != nil {
+		return err
+	}
+	return hook.flushWriter(ctx)
+}
+
+// waitQueue waits for the log queue to be empty, or for ctx to be done.
+// The mutex of the hook is not held, as the error handler called by the
+// workers may log with the hook.
+func (hook *GraylogHook) waitQueue(ctx context.Context) error {
+	for {
+		// Taken before checking the queue, so that a drain in between
+		// isn't missed
+		drained := hook.drainedChan()
+		queued := atomic.LoadInt64(&hook.queued)
+		if queued == 0 {
+			return nil
+		}
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			// The queue may have drained while waiting
+			queued = atomic.LoadInt64(&hook.queued)
+			if queued == 0 {
+				return nil
+			}
+			return &FlushError{Pending: int(queued) + hook.pendingLen(), Err: ctx.Err()}
+		}
+	}
+}
+
+// Close sends the queued entries, stops the background goroutines of the
+// hook and closes its writer. The messages kept while the hook was not
+// connected yet are passed to the error handler, or spooled, with
+// ErrNotConnected. Entries fired after Close are rejected with ErrClosed.
+func (hook *GraylogHook) Close() error {
+	if !atomic.CompareAndSwapInt32(&hook.closed, 0, 1) {
+		return nil
+	}
+	// Wait for the entries being fired, then for the queue to be sent
+	// without holding the mutex, as the error handler may log with the hook.
+	hook.mu.Lock()
+	hook.mu.Unlock()
 	hook.wg.Wait()
+	for _, l := range hook.lanes {
+		close(l.buf)
+	}
+
+	close(hook.quit)
+	if hook.fireDone != nil {
+		<-hook.fireDone
+	}
+	if hook.connectDone != nil {
+		<-hook.connectDone
+	}
+	hook.losePending()
+	// The messages the writer can't send may be spooled
+	hook.flushWriter(context.Background())
+	if hook.spoolDone != nil {
+		<-hook.spoolDone
+		if err := hook.spool.close(); err != nil {
+			hook.handleError(fmt.Errorf("can't close spool: %w", err), nil)
+		}
+	}
+
+	if c, ok := hook.Writer().(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
-// fire will loop on the 'buf' channel, and write entries to graylog
+// fire sends the entries of the lanes with the workers of the hook, until
+// the lanes are closed.
 func (hook *GraylogHook) fire() {
+	defer close(hook.fireDone)
+
+	workers := hook.queue.workers()
+	if workers == 1 {
+		hook.work(hook.next)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	if hook.queue.ShardField == "" {
+		for i := 0; i < workers; i++ {
+			go func() {
+				defer wg.Done()
+				hook.work(hook.next)
+			}()
+		}
+		wg.Wait()
+		return
+	}
+
+	shards := make([]chan graylogEntry, workers)
+	for i := range shards {
+		shards[i] = make(chan graylogEntry, 1)
+		go func(entries <-chan graylogEntry) {
+			defer wg.Done()
+			hook.work(receive(entries))
+		}(shards[i])
+	}
+	var next uint32
 	for {
-		entry := <-hook.buf // receive new entry on channel
-		hook.sendEntry(entry)
-		hook.wg.Done()
+		entry, ok := hook.next()
+		if !ok {
+			break
+		}
+		shards[hook.shard(entry, &next, workers)] <- entry
 	}
+	for _, shard := range shards {
+		close(shard)
+	}
+	wg.Wait()
+}
+
+// done accounts for an entry that left the queue.
+func (hook *GraylogHook) done() {
+	if atomic.AddInt64(&hook.queued, -1) == 0 {
+		hook.signalDrained()
+	}
+	hook.wg.Done()
+}
+
+// signalDrained wakes up all the waitQueue calls, to check whether the
+// queue is empty.
+func (hook *GraylogHook) signalDrained() {
+	hook.drainMu.Lock()
+	defer hook.drainMu.Unlock()
+
+	close(hook.drained)
+	hook.drained = make(chan struct{})
+}
+
+// drainedChan returns the channel closed the next time the queue drains.
+func (hook *GraylogHook) drainedChan() <-chan struct{} {
+	hook.drainMu.Lock()
+	defer hook.drainMu.Unlock()
+
+	return hook.drained
 }
 
 func logrusLevelToSyslog(level logrus.Level) int32 {
@@ -184,13 +450,12 @@ func logrusLevelToSyslog(level logrus.Level) int32 {
 }
 
 // sendEntry sends an entry to graylog synchronously
-func (hook *GraylogHook) sendEntry(entry graylogEntry) {
-	if hook.gelfLogger == nil {
-		fmt.Println("Can't connect to Graylog")
-		return
-	}
-	w := hook.gelfLogger
+func (hook *GraylogHook) sendEntry(entry graylogEntry) error {
+	return hook.writeMessage(hook.newMessage(entry))
+}
 
+// newMessage builds the GELF message of an entry
+func (hook *GraylogHook) newMessage(entry graylogEntry) *Message {
 	// remove trailing and leading whitespace
 	p := bytes.TrimSpace([]byte(entry.Message))
 
@@ -241,21 +506,78 @@ func (hook *GraylogHook) sendEntry(entry graylogEntry) {
 		}
 	}
 
-	m := Message{
+	return &Message{
 		Version:  "1.1",
 		Host:     hook.Host,
+		Facility: hook.Facility,
 		Short:    string(short),
 		Full:     string(full),
-		TimeUnix: float64(time.Now().UnixNano()/1000000) / 1000.,
+		TimeUnix: hook.timestamp(entry.Time),
 		Level:    level,
 		File:     entry.file,
 		Line:     entry.line,
 		Extra:    extra,
 	}
+}
+
+// writeMessage writes a message with the hook writer, or keeps it until
+// the hook is connected. The errors are wrapped in a *MessageError.
+func (hook *GraylogHook) writeMessage(m *Message) error {
+	w := hook.Writer()
+	if w == nil {
+		var dropped []*Message
+		w, dropped = hook.addPending(m)
+		for _, d := range dropped {
+			atomic.AddUint64(&hook.stats.failed, 1)
+			hook.lose(ErrNotConnected, d)
+		}
+		if w == nil {
+			return nil
+		}
+	}
 
-	if err := w.WriteMessage(&m); err != nil {
-		fmt.Println(err)
+	if err := w.WriteMessage(m); err != nil {
+		atomic.AddUint64(&hook.stats.failed, 1)
+		hook.stats.countError(writerTransport(w))
+		return &MessageError{Err: err, Message: m}
 	}
+	atomic.AddUint64(&hook.stats.sent, 1)
+	return nil
+}
+
+// handleError passes an error to the error handler of the hook. The
+// message is taken from err if m is nil and err is a *MessageError.
+func (hook *GraylogHook) handleError(err error, m *Message) {
+	err, m = unwrapMessageError(err, m)
+
+	transport := hook.transport
+	if w := hook.Writer(); w != nil {
+		transport = writerTransport(w)
+	}
+
+	handler := hook.ErrorHandler
+	if handler == nil {
+		handler = DefaultErrorHandler
+	}
+	handler(err, m, transport)
+}
+
+// timestamp returns the GELF timestamp of an entry time. Entries are
+// timestamped when they are logged, rather than when they are sent, so that
+// asynchronous hooks don't report the time spent in their queue.
+func (hook *GraylogHook) timestamp(t time.Time) float64 {
+	if t.IsZero() {
+		clock := hook.Clock
+		if clock == nil {
+			clock = time.Now
+		}
+		t = clock()
+	}
+	precision := hook.TimestampPrecision
+	if precision <= 0 {
+		precision = time.Millisecond
+	}
+	return gelfTimestamp(t, precision)
 }
 
 // Levels returns the available logging levels.
@@ -279,16 +601,20 @@ func (hook *GraylogHook) Blacklist(b []string) {
 	}
 }
 
-// SetWriter sets the hook Gelf writer
+// SetWriter sets the hook Gelf writer.
+// Messages kept while the hook was not connected are written with w.
 func (hook *GraylogHook) SetWriter(w *LowLevelProtocolWriter) error {
 	if w == nil {
 		return errors.New("writer can't be nil")
 	}
-	hook.gelfLogger = w
+	hook.setWriter(w)
 	return nil
 }
 
-// Writer returns the writer
+// Writer returns the writer, or nil if the hook is not connected yet
 func (hook *GraylogHook) Writer() GELFWriter {
+	hook.connMu.RLock()
+	defer hook.connMu.RUnlock()
+
 	return hook.gelfLogger
 }
@@ -2,6 +2,7 @@ package graylog
 
 import (
 	"compress/flate"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,6 +16,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	pkgerrors "github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -99,11 +101,11 @@ func TestWritingToTCP(t *testing.T) {
 	wg.Add(1)
 
 	go func(msgData string, wg *sync.WaitGroup) {
-		r := new(Reader)
-		r.conn, err = listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			fmt.Println(err)
 		}
+		r := NewStreamReader(conn)
 
 		msg, err := r.ReadMessage()
 
@@ -352,7 +354,7 @@ func TestStackTracer(t *testing.T) {
 			msg.File)
 	}
 
-	lineExpected := 342 // Update this if code is updated above
+	lineExpected := 344 // Update this if code is updated above
 	if msg.Line != lineExpected {
 		t.Errorf("msg.Line: expected %d, got %d", lineExpected, msg.Line)
 	}
@@ -370,7 +372,7 @@ func TestStackTracer(t *testing.T) {
 	if !strings.Contains(runtime.Version(), "devel") {
 		stacktraceRE := regexp.MustCompile(`^
 (.+)?logrus-graylog-hook(/v3)?.TestStackTracer
-	(/|[A-Z]:/).+/logrus-graylog-hook(.v3)?/graylog_hook_test.go:\d+
+	(/|[A-Z]:/).+/graylog_hook_test.go:\d+
 testing.tRunner
 	(/|[A-Z]:/).*/testing.go:\d+
 runtime.*
@@ -470,7 +472,7 @@ func TestReportCallerEnabled(t *testing.T) {
 		t.Error("_line dowes not have the correct type")
 	}
 
-	lineExpected := 440 // Update this if code is updated above
+	lineExpected := 442 // Update this if code is updated above
 	if msg.Line != lineExpected {
 		t.Errorf("msg.Extra[\"_line\"]: expected %d, got %d", lineExpected, int(lineGot))
 	}
@@ -496,9 +498,8 @@ func TestReportCallerEnabled(t *testing.T) {
 			msg.File)
 	}
 
-	gelfLineExpected := 440 // Update this if code is updated above
 	if msg.Line != lineExpected {
-		t.Errorf("msg.Line: expected %d, got %d", gelfLineExpected, msg.Line)
+		t.Errorf("msg.Line: expected %d, got %d", lineExpected, msg.Line)
 	}
 }
 
@@ -582,3 +583,609 @@ func TestHTTPWriter(t *testing.T) {
 	log.Hooks.Add(hook)
 	log.Info(msgData)
 }
+
+func TestLazyConnection(t *testing.T) {
+	// Reserve an address, and stop listening so that the hook can't
+	// connect on creation.
+	listener, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	logrus.SetOutput(io.Discard)
+	hook := NewGraylogHook("tcp://"+addr, nil)
+	hook.PendingLimit = 2
+	if hook.Writer() != nil {
+		t.Fatal("hook should not be connected")
+	}
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Info("dropped")
+	log.Info("first")
+	log.Info("second")
+
+	listener, err = NewTCPReader(addr)
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	defer listener.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	defer conn.Close()
+
+	r := NewStreamReader(conn)
+	for _, expected := range []string{"first", "second"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %s, got %s", expected, msg.Short)
+		}
+	}
+	if hook.Writer() == nil {
+		t.Error("hook should be connected")
+	}
+}
+
+func TestClose(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook := NewAsyncGraylogHook(r.Addr(), nil)
+	w := hook.Writer()
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Info("before close")
+
+	if err := hook.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "before close" {
+		t.Errorf("msg.Short: expected %s, got %s", "before close", msg.Short)
+	}
+
+	select {
+	case <-hook.fireDone:
+	default:
+		t.Error("fire goroutine should be stopped")
+	}
+	if err := hook.Fire(logrus.NewEntry(log)); err != ErrClosed {
+		t.Errorf("Fire: expected ErrClosed, got %v", err)
+	}
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "after close"}); err != ErrClosed {
+		t.Errorf("WriteMessage: expected ErrClosed, got %v", err)
+	}
+	if err := hook.Close(); err != nil {
+		t.Errorf("Close should be idempotent, got %s", err)
+	}
+}
+
+func TestCloseWhileConnecting(t *testing.T) {
+	listener, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	logrus.SetOutput(io.Discard)
+	hook := NewGraylogHook("tcp://"+addr, nil)
+	if err := hook.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	select {
+	case <-hook.connectDone:
+	default:
+		t.Error("connect goroutine should be stopped")
+	}
+}
+
+// blockingWriter is a GELFWriter which blocks until release is closed.
+// Messages are sent to received, if not nil, before blocking.
+type blockingWriter struct {
+	release  chan struct{}
+	received chan *Message
+}
+
+func (w *blockingWriter) WriteMessage(m *Message) error {
+	if w.received != nil {
+		w.received <- m
+	}
+	<-w.release
+	return nil
+}
+
+func TestFlushContext(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook := NewAsyncGraylogHook(r.Addr(), nil)
+	w := &blockingWriter{release: make(chan struct{})}
+	hook.setWriter(w)
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	for i := 0; i < 3; i++ {
+		log.Info("pending")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = hook.FlushContext(ctx)
+	var flushErr *FlushError
+	if !errors.As(err, &flushErr) {
+		t.Fatalf("FlushContext: expected a *FlushError, got %v", err)
+	}
+	if flushErr.Pending != 3 {
+		t.Errorf("expected 3 pending entries, got %d", flushErr.Pending)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("FlushContext: expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// Logging must not be blocked by the expired flush
+	log.Info("pending")
+
+	close(w.release)
+	if err := hook.FlushContext(context.Background()); err != nil {
+		t.Errorf("FlushContext: %s", err)
+	}
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy   OverflowPolicy
+		expected []string
+	}{
+		{OverflowDropNewest, []string{"first", "second"}},
+		{OverflowDropOldest, []string{"first", "third"}},
+		{OverflowBlockTimeout, []string{"first", "second"}},
+	}
+
+	for _, test := range tests {
+		r, err := NewUDPReader("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("NewUDPReader: %s", err)
+		}
+		hook := NewAsyncGraylogHookWithQueue(r.Addr(), nil, QueueConfig{
+			Size:     1,
+			Overflow: test.policy,
+			Timeout:  10 * time.Millisecond,
+		})
+		w := &blockingWriter{release: make(chan struct{}), received: make(chan *Message, 3)}
+		hook.setWriter(w)
+
+		log := logrus.New()
+		log.Out = io.Discard
+		log.Hooks.Add(hook)
+
+		log.Info("first")
+		<-w.received // "first" is being written, the queue is empty
+		log.Info("second")
+		start := time.Now()
+		log.Info("third")
+		if test.policy == OverflowBlockTimeout && time.Since(start) < 10*time.Millisecond {
+			t.Errorf("policy %d: Fire should block until the timeout", test.policy)
+		}
+
+		close(w.release)
+		hook.Flush()
+		close(w.received)
+		got := []string{"first"}
+		for m := range w.received {
+			got = append(got, m.Short)
+		}
+		if strings.Join(got, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("policy %d: expected %v, got %v", test.policy, test.expected, got)
+		}
+		if hook.Dropped() != 1 {
+			t.Errorf("policy %d: expected 1 dropped entry, got %d", test.policy, hook.Dropped())
+		}
+	}
+}
+
+// failingWriter is a GELFWriter which fails to write any message.
+type failingWriter struct{}
+
+var errWriteFailed = errors.New("write failed")
+
+func (failingWriter) WriteMessage(m *Message) error {
+	return errWriteFailed
+}
+
+func (failingWriter) Transport() string {
+	return "failing"
+}
+
+func TestErrorHandler(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+
+	var handled []string
+	hook, err := New(r.Addr(), WithErrorHandler(func(err error, m *Message, transport string) {
+		if err != errWriteFailed {
+			t.Errorf("unexpected error %v", err)
+		}
+		handled = append(handled, fmt.Sprintf("%s:%s", transport, m.Short))
+	}))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	hook.setWriter(failingWriter{})
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Info("lost")
+
+	if len(handled) != 1 || handled[0] != "failing:lost" {
+		t.Errorf("expected the error handler to be called once, got %v", handled)
+	}
+
+	hook.ReturnErrors = true
+	err = hook.Fire(&logrus.Entry{Logger: log, Level: logrus.InfoLevel, Message: "returned"})
+	if !errors.Is(err, errWriteFailed) {
+		t.Errorf("Fire: expected errWriteFailed, got %v", err)
+	}
+	var msgErr *MessageError
+	if !errors.As(err, &msgErr) || msgErr.Message.Short != "returned" {
+		t.Errorf("Fire: expected a *MessageError, got %#v", err)
+	}
+	if len(handled) != 1 {
+		t.Errorf("returned errors should not be handled, got %v", handled)
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	logged := time.Date(2020, 2, 3, 4, 5, 6, 123456789, time.UTC)
+	clock := time.Date(2021, 2, 3, 4, 5, 6, 987654321, time.UTC)
+
+	tests := []struct {
+		opts     []Option
+		time     time.Time
+		expected float64
+	}{
+		{nil, logged, 1580702706.123},
+		{[]Option{WithTimestampPrecision(time.Microsecond)}, logged, 1580702706.123456},
+		{[]Option{WithClock(func() time.Time { return clock })}, time.Time{}, 1612325106.987},
+	}
+
+	for i, test := range tests {
+		hook, err := New(r.Addr(), test.opts...)
+		if err != nil {
+			t.Fatalf("New: %s", err)
+		}
+		log := logrus.New()
+		if err := hook.Fire(&logrus.Entry{Logger: log, Time: test.time, Level: logrus.InfoLevel, Message: "timestamp"}); err != nil {
+			t.Fatalf("Fire: %s", err)
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("ReadMessage: %s", err)
+		}
+		if msg.TimeUnix != test.expected {
+			t.Errorf("test %d: expected timestamp %f, got %f", i, test.expected, msg.TimeUnix)
+		}
+	}
+
+	if _, err := New(r.Addr(), WithTimestampPrecision(7*time.Millisecond)); err == nil {
+		t.Error("WithTimestampPrecision should reject precisions which don't divide a second")
+	}
+}
+
+// recordingWriter records the messages written, slowly.
+type recordingWriter struct {
+	mu       sync.Mutex
+	messages []*Message
+}
+
+func (w *recordingWriter) WriteMessage(m *Message) error {
+	time.Sleep(time.Millisecond)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.messages = append(w.messages, m)
+	return nil
+}
+
+func TestWorkers(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook := NewAsyncGraylogHookWithQueue(r.Addr(), nil, QueueConfig{Size: 10, Workers: 3})
+	w := &blockingWriter{release: make(chan struct{}), received: make(chan *Message, 3)}
+	hook.setWriter(w)
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	for i := 0; i < 3; i++ {
+		log.Info("concurrent")
+	}
+	// The 3 entries are written at the same time
+	for i := 0; i < 3; i++ {
+		select {
+		case <-w.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected 3 concurrent writes, got %d", i)
+		}
+	}
+	close(w.release)
+	hook.Close()
+}
+
+func TestWorkersSharding(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook := NewAsyncGraylogHookWithQueue(r.Addr(), nil, QueueConfig{Size: 10, Workers: 4, ShardField: "caller"})
+	w := new(recordingWriter)
+	hook.setWriter(w)
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	var wg sync.WaitGroup
+	for caller := 0; caller < 8; caller++ {
+		wg.Add(1)
+		go func(caller int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				log.WithField("caller", caller).Info(fmt.Sprint(i))
+			}
+		}(caller)
+	}
+	wg.Wait()
+	log.Info("without caller")
+	hook.Flush()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.messages) != 8*20+1 {
+		t.Fatalf("expected %d messages after Flush, got %d", 8*20+1, len(w.messages))
+	}
+	next := make(map[interface{}]int)
+	for _, m := range w.messages {
+		caller, ok := m.Extra["_caller"]
+		if !ok {
+			continue
+		}
+		if m.Short != fmt.Sprint(next[caller]) {
+			t.Errorf("caller %v: expected entry %d, got %s", caller, next[caller], m.Short)
+		}
+		next[caller]++
+	}
+	hook.Close()
+}
+
+func TestWorkersClose(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	for _, shardField := range []string{"", "caller"} {
+		hook := NewAsyncGraylogHookWithQueue(r.Addr(), nil, QueueConfig{Size: 5, Workers: 4, ShardField: shardField})
+		w := new(recordingWriter)
+		hook.setWriter(w)
+
+		log := logrus.New()
+		log.Out = io.Discard
+		log.Hooks.Add(hook)
+		for i := 0; i < 50; i++ {
+			log.WithField("caller", i%3).Info("closing")
+		}
+		hook.Close()
+
+		w.mu.Lock()
+		if len(w.messages) != 50 {
+			t.Errorf("shard field %q: expected 50 messages after Close, got %d", shardField, len(w.messages))
+		}
+		w.mu.Unlock()
+	}
+}
+
+func TestNewAsyncGraylogHookWithInvalidQueue(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook := NewAsyncGraylogHookWithQueue(r.Addr(), nil, QueueConfig{Size: 1, Overflow: OverflowBlockTimeout})
+	if hook == nil {
+		t.Fatal("expected a hook despite the invalid queue")
+	}
+	defer hook.Close()
+	w := &blockingWriter{release: make(chan struct{}), received: make(chan *Message, 3)}
+	hook.setWriter(w)
+	hook.ErrorHandler = func(err error, m *Message, transport string) {}
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+
+	log.Info("first")
+	<-w.received // "first" is being written, the queue is empty
+	log.Info("second")
+	log.Info("third") // dropped, as OverflowDropNewest does
+
+	close(w.release)
+	hook.Flush()
+	if hook.Dropped() != 1 {
+		t.Errorf("expected 1 dropped entry, got %d", hook.Dropped())
+	}
+}
+
+func TestErrorHandlerLogsWithHook(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook := NewAsyncGraylogHook(r.Addr(), nil)
+	hook.setWriter(failingWriter{})
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	logged := make(chan struct{}, 2) // the entries of the handler fail too
+	hook.ErrorHandler = func(err error, m *Message, transport string) {
+		select {
+		case logged <- struct{}{}:
+			log.WithError(err).Warn("can't send to Graylog")
+		default:
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		log.Info("first")
+		hook.Flush()
+		log.Info("second")
+		hook.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush and Close should not wait for the entries of the error handler")
+	}
+}
+
+func TestCloseLosesPending(t *testing.T) {
+	listener, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	var mu sync.Mutex
+	var lost []string
+	handler := func(err error, m *Message, transport string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if errors.Is(err, ErrNotConnected) && m != nil {
+			lost = append(lost, m.Short)
+		}
+	}
+	hook, err := New("tcp://"+addr, WithAsync(), WithLazyConnect(), WithErrorHandler(handler))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	for i := 0; i < 3; i++ {
+		log.Info(fmt.Sprint("message ", i))
+	}
+
+	// Flush doesn't wait for the hook to connect
+	flushed := make(chan struct{})
+	go func() {
+		hook.Flush()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Fatal("Flush should not wait for the hook to connect")
+	}
+
+	if err := hook.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(lost, ",") != "message 0,message 1,message 2" {
+		t.Errorf("expected the pending messages to be lost on Close, got %v", lost)
+	}
+	if stats := hook.Stats(); stats.Failed != 3 {
+		t.Errorf("expected 3 failed messages, got %d", stats.Failed)
+	}
+}
+
+func TestConcurrentFlushContext(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook := NewAsyncGraylogHook(r.Addr(), nil)
+	defer hook.Close()
+	w := &blockingWriter{release: make(chan struct{}), received: make(chan *Message, 1)}
+	hook.setWriter(w)
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Info("blocked")
+	<-w.received
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- hook.FlushContext(ctx) }()
+	}
+	time.Sleep(50 * time.Millisecond) // let both calls wait
+	close(w.release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("FlushContext: %s", err)
+		}
+	}
+}
+
+func TestFlushContextPendingOnExpiry(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook := NewAsyncGraylogHook(r.Addr(), nil)
+	w := &blockingWriter{release: make(chan struct{}), received: make(chan *Message, 3)}
+	hook.setWriter(w)
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	for i := 0; i < 3; i++ {
+		log.Info("pending")
+	}
+
+	// One entry is sent while FlushContext waits
+	go func() {
+		<-w.received
+		w.release <- struct{}{}
+		<-w.received
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var flushErr *FlushError
+	if err := hook.FlushContext(ctx); !errors.As(err, &flushErr) || flushErr.Pending != 2 {
+		t.Errorf("FlushContext: expected 2 pending entries, got %v", err)
+	}
+
+	close(w.release)
+	hook.Close()
+}
@@ -0,0 +1,310 @@
+package graylog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BatchConfig configures the batching of HTTP writers. Batched messages
+// are sent newline-delimited in a single request once MaxMessages or
+// MaxBytes is reached, or once the oldest one waited for Linger.
+//
+// WriteMessage only fails for the messages which can't be batched. The
+// messages of the batches which can't be sent are passed to the
+// ErrorHandler of the writer, and to the error handler or the spool of
+// the hook using the writer.
+//
+// Servers rejecting batches with a 400, 413, 415 or 422 status are
+// assumed not to support them: the batch is sent again one message per
+// request, and so are all the following messages.
+type BatchConfig struct {
+	MaxMessages int           // messages per request, defaults to 100
+	MaxBytes    int           // size of a request before compression, defaults to 1MiB
+	Linger      time.Duration // longest wait of a message, defaults to one second
+}
+
+const (
+	defaultBatchMessages = 100
+	defaultBatchBytes    = 1 << 20
+	defaultBatchLinger   = time.Second
+)
+
+// httpBatch holds the messages waiting to be sent by an HTTP writer.
+type httpBatch struct {
+	config BatchConfig
+
+	mu       sync.Mutex
+	messages []*Message
+	encoded  [][]byte
+	size     int                         // size of the messages and their delimiters
+	lost     func(err error, m *Message) // set by the hook using the writer
+
+	sending   chan struct{} // holds a token while a batch is sent, to keep batches in order
+	unbatched int32         // set once the server rejected a batch
+	stop      chan struct{} // closed to stop the linger loop
+	stopped   chan struct{} // closed once the linger loop returned
+}
+
+// full reports whether the batch should be sent. b.mu must be held.
+func (b *httpBatch) full() bool {
+	return len(b.messages) >= b.config.MaxMessages || b.size >= b.config.MaxBytes
+}
+
+// putBack adds messages which couldn't be sent back to the front of the
+// batch. b.mu must be held.
+func (b *httpBatch) putBack(messages []*Message, encoded [][]byte) {
+	b.messages = append(messages[:len(messages):len(messages)], b.messages...)
+	b.encoded = append(encoded[:len(encoded):len(encoded)], b.encoded...)
+	for _, e := range encoded {
+		b.size += len(e) + 1
+	}
+}
+
+// take removes the messages of the next request from the batch. b.mu
+// must be held.
+func (b *httpBatch) take() ([]*Message, [][]byte) {
+	n, size := 0, 0
+	for n < len(b.messages) && n < b.config.MaxMessages {
+		if n > 0 && size+len(b.encoded[n])+1 > b.config.MaxBytes {
+			break
+		}
+		size += len(b.encoded[n]) + 1
+		n++
+	}
+	messages, encoded := b.messages[:n:n], b.encoded[:n:n]
+	b.messages, b.encoded = b.messages[n:], b.encoded[n:]
+	b.size -= size
+	return messages, encoded
+}
+
+func (h *HTTPWriter) startBatching(config BatchConfig) {
+	if config.MaxMessages <= 0 {
+		config.MaxMessages = defaultBatchMessages
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultBatchBytes
+	}
+	if config.Linger <= 0 {
+		config.Linger = defaultBatchLinger
+	}
+	h.batch = &httpBatch{
+		config:  config,
+		sending: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go h.lingerLoop()
+}
+
+// stopBatching rejects new messages, and sends the batched ones.
+func (h *HTTPWriter) stopBatching() error {
+	h.batch.mu.Lock()
+	atomic.StoreInt32(&h.closed, 1)
+	h.batch.mu.Unlock()
+
+	select {
+	case <-h.batch.stop:
+	default:
+		close(h.batch.stop)
+	}
+	<-h.batch.stopped
+	return h.flushBatch(context.Background(), true)
+}
+
+// batching reports whether messages are batched.
+func (h *HTTPWriter) batching() bool {
+	return h.batch != nil && atomic.LoadInt32(&h.batch.unbatched) == 0
+}
+
+// setLostHandler sets the function called with the batched messages which
+// couldn't be sent.
+func (h *HTTPWriter) setLostHandler(lost func(err error, m *Message)) {
+	if h.batch == nil {
+		return
+	}
+	h.batch.mu.Lock()
+	h.batch.lost = lost
+	h.batch.mu.Unlock()
+}
+
+// lingerLoop sends the batched messages every Linger.
+func (h *HTTPWriter) lingerLoop() {
+	defer close(h.batch.stopped)
+
+	ticker := time.NewTicker(h.batch.config.Linger)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.batch.stop:
+			return
+		case <-ticker.C:
+			h.flushBatch(context.Background(), true)
+		}
+	}
+}
+
+// Flush sends the batched messages. The messages which can't be sent are
+// reported as if sent in background, and the last error is returned.
+func (h *HTTPWriter) Flush() error {
+	return h.FlushContext(context.Background())
+}
+
+// FlushContext sends the batched messages like Flush, or stops once ctx is
+// done. In the latter case, a *FlushError reports how many messages are
+// still batched. They are not discarded, and will still be sent in
+// background.
+func (h *HTTPWriter) FlushContext(ctx context.Context) error {
+	if h.batch == nil {
+		return nil
+	}
+	return h.flushBatch(ctx, true)
+}
+
+func (h *HTTPWriter) addToBatch(m *Message) error {
+	mBytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	h.batch.mu.Lock()
+	if atomic.LoadInt32(&h.closed) != 0 {
+		h.batch.mu.Unlock()
+		return ErrClosed
+	}
+	atomic.AddUint64(&h.stats.bytes, uint64(len(mBytes)))
+	h.batch.messages = append(h.batch.messages, m)
+	h.batch.encoded = append(h.batch.encoded, mBytes)
+	h.batch.size += len(mBytes) + 1
+	full := h.batch.full()
+	h.batch.mu.Unlock()
+
+	if full {
+		h.flushBatch(context.Background(), false)
+	}
+	return nil
+}
+
+// flushBatch sends the batched messages, all of them if force is set, or
+// as long as the batch is full otherwise. Once ctx is done, the messages
+// not sent are kept in the batch, and a *FlushError is returned.
+func (h *HTTPWriter) flushBatch(ctx context.Context, force bool) (err error) {
+	select {
+	case h.batch.sending <- struct{}{}:
+	case <-ctx.Done():
+		return h.batchPending(ctx)
+	}
+	defer func() { <-h.batch.sending }()
+
+	for {
+		if ctx.Err() != nil {
+			return h.batchPending(ctx)
+		}
+		h.batch.mu.Lock()
+		if len(h.batch.messages) == 0 || !force && !h.batch.full() {
+			h.batch.mu.Unlock()
+			return err
+		}
+		messages, encoded := h.batch.take()
+		lost := h.batch.lost
+		h.batch.mu.Unlock()
+
+		if serr := h.sendBatch(ctx, messages, encoded, lost); serr != nil {
+			err = serr
+		}
+	}
+}
+
+// batchPending returns the *FlushError of a flush stopped because ctx is
+// done.
+func (h *HTTPWriter) batchPending(ctx context.Context) error {
+	h.batch.mu.Lock()
+	defer h.batch.mu.Unlock()
+
+	return &FlushError{Pending: len(h.batch.messages), Err: ctx.Err()}
+}
+
+// keepUnsent puts messages back in the batch if they couldn't be sent
+// because ctx is done, and reports whether it did.
+func (h *HTTPWriter) keepUnsent(ctx context.Context, messages []*Message, encoded [][]byte) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	h.batch.mu.Lock()
+	h.batch.putBack(messages, encoded)
+	h.batch.mu.Unlock()
+	return true
+}
+
+// sendBatch sends messages in a single request, or one per request if
+// the server doesn't support batches.
+func (h *HTTPWriter) sendBatch(ctx context.Context, messages []*Message, encoded [][]byte, lost func(error, *Message)) error {
+	if atomic.LoadInt32(&h.batch.unbatched) != 0 {
+		return h.sendEach(ctx, messages, encoded, lost)
+	}
+
+	body, encoding, err := h.compress(bytes.Join(encoded, []byte{'\n'}))
+	if err == nil {
+		atomic.AddUint64(&h.stats.compressedBytes, uint64(len(body)))
+		err = h.send(ctx, body, encoding)
+	}
+	if err != nil && h.keepUnsent(ctx, messages, encoded) {
+		return err
+	}
+	if err != nil && len(messages) > 1 && rejectsBatches(err) {
+		atomic.StoreInt32(&h.batch.unbatched, 1)
+		return h.sendEach(ctx, messages, encoded, lost)
+	}
+
+	for _, m := range messages {
+		h.reportBatched(err, m, lost)
+	}
+	return err
+}
+
+// sendEach sends messages one per request.
+func (h *HTTPWriter) sendEach(ctx context.Context, messages []*Message, encoded [][]byte, lost func(error, *Message)) (err error) {
+	for i, m := range messages {
+		body, encoding, merr := h.compress(encoded[i])
+		if merr == nil {
+			atomic.AddUint64(&h.stats.compressedBytes, uint64(len(body)))
+			merr = h.send(ctx, body, encoding)
+		}
+		if merr != nil && h.keepUnsent(ctx, messages[i:], encoded[i:]) {
+			return merr
+		}
+		h.reportBatched(merr, m, lost)
+		if merr != nil {
+			err = merr
+		}
+	}
+	return err
+}
+
+// reportBatched reports a batched message sent, or not, in background.
+func (h *HTTPWriter) reportBatched(err error, m *Message, lost func(error, *Message)) {
+	h.report(err, m)
+	if err != nil && lost != nil {
+		lost(err, m)
+	}
+}
+
+// rejectsBatches reports whether a batch failed with err because the
+// server doesn't support batches.
+func rejectsBatches(err error) bool {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	switch httpErr.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge,
+		http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
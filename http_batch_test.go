@@ -0,0 +1,276 @@
+package graylog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// batchServer records the messages of every request it gets.
+type batchServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests [][]string // short messages, by request
+	received chan struct{}
+	status   func(body []byte) int
+}
+
+func newBatchServer(t *testing.T) *batchServer {
+	s := &batchServer{received: make(chan struct{}, 100)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("ReadAll: %s", err)
+		}
+		if s.status != nil {
+			if status := s.status(body); status != http.StatusAccepted {
+				rw.WriteHeader(status)
+				return
+			}
+		}
+		var shorts []string
+		for _, line := range bytes.Split(body, []byte{'\n'}) {
+			var m Message
+			if err := json.Unmarshal(line, &m); err != nil {
+				t.Errorf("Unmarshal: %s", err)
+			}
+			shorts = append(shorts, m.Short)
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, shorts)
+		s.mu.Unlock()
+		s.received <- struct{}{}
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	return s
+}
+
+func (s *batchServer) batches() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.requests...)
+}
+
+func writeShorts(t *testing.T, w GELFWriter, shorts ...string) {
+	for _, short := range shorts {
+		if err := w.WriteMessage(&Message{Version: "1.1", Short: short}); err != nil {
+			t.Fatalf("WriteMessage: %s", err)
+		}
+	}
+}
+
+func TestHTTPBatchThresholds(t *testing.T) {
+	server := newBatchServer(t)
+	defer server.Close()
+
+	w, err := NewWriter(server.URL, WithHTTPBatch(BatchConfig{MaxMessages: 3, Linger: time.Hour}))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	writeShorts(t, w, "1", "2", "3", "4", "5", "6", "7")
+	if got := server.batches(); len(got) != 2 || len(got[0]) != 3 || len(got[1]) != 3 {
+		t.Fatalf("expected 2 requests of 3 messages, got %v", got)
+	}
+	if err := w.(*HTTPWriter).Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	got := server.batches()
+	if len(got) != 3 || len(got[2]) != 1 || got[2][0] != "7" {
+		t.Errorf("expected the last message to be flushed, got %v", got)
+	}
+	if stats := w.(*HTTPWriter).Stats(); stats.Messages != 7 {
+		t.Errorf("expected 7 messages sent, got %d", stats.Messages)
+	}
+
+	// The size of the messages is a threshold too
+	server = newBatchServer(t)
+	defer server.Close()
+	w, err = NewWriter(server.URL, WithHTTPBatch(BatchConfig{MaxBytes: 200, Linger: time.Hour}))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	writeShorts(t, w, "1", "2", "3")
+	for _, batch := range server.batches() {
+		if len(batch) >= 3 {
+			t.Errorf("expected batches to be smaller than 200 bytes, got %v", batch)
+		}
+	}
+}
+
+func TestHTTPBatchLinger(t *testing.T) {
+	server := newBatchServer(t)
+	defer server.Close()
+
+	w, err := NewWriter(server.URL, WithHTTPBatch(BatchConfig{Linger: 20 * time.Millisecond}))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	defer w.(io.Closer).Close()
+	writeShorts(t, w, "lingering")
+	select {
+	case <-server.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the batch should be sent after Linger")
+	}
+	if got := server.batches(); len(got) != 1 || got[0][0] != "lingering" {
+		t.Errorf("unexpected batches %v", got)
+	}
+}
+
+func TestHTTPBatchFallback(t *testing.T) {
+	server := newBatchServer(t)
+	server.status = func(body []byte) int {
+		if bytes.Contains(body, []byte{'\n'}) {
+			return http.StatusBadRequest
+		}
+		return http.StatusAccepted
+	}
+	defer server.Close()
+
+	w, err := NewWriter(server.URL, WithHTTPBatch(BatchConfig{MaxMessages: 2, Linger: time.Hour}))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	writeShorts(t, w, "1", "2")
+	if got := server.batches(); len(got) != 2 {
+		t.Fatalf("expected the batch to be sent again one message per request, got %v", got)
+	}
+
+	// Messages are not batched anymore
+	writeShorts(t, w, "3")
+	if got := server.batches(); len(got) != 3 || got[2][0] != "3" {
+		t.Errorf("expected the message to be sent at once, got %v", got)
+	}
+}
+
+func TestHTTPBatchHook(t *testing.T) {
+	server := newBatchServer(t)
+	defer server.Close()
+
+	hook, err := New(server.URL, WithAsync(), WithWriterOptions(WithHTTPBatch(BatchConfig{Linger: time.Hour})))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Info("first")
+	log.Info("second")
+	hook.Flush()
+	if got := server.batches(); len(got) != 1 || len(got[0]) != 2 {
+		t.Errorf("expected Flush to send the batch, got %v", got)
+	}
+
+	log.Info("third")
+	hook.Close()
+	if got := server.batches(); len(got) != 2 || got[1][0] != "third" {
+		t.Errorf("expected Close to send the batch, got %v", got)
+	}
+}
+
+func TestHTTPBatchErrors(t *testing.T) {
+	server := newBatchServer(t)
+	server.status = func([]byte) int {
+		return http.StatusInternalServerError
+	}
+	defer server.Close()
+
+	var mu sync.Mutex
+	var writerErrors, hookErrors []string
+	hook, err := New(server.URL,
+		WithWriterOptions(WithHTTPBatch(BatchConfig{Linger: time.Hour})),
+		WithErrorHandler(func(err error, m *Message, transport string) {
+			mu.Lock()
+			defer mu.Unlock()
+			hookErrors = append(hookErrors, m.Short)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	w := hook.Writer().(*HTTPWriter)
+	w.Backoff = Backoff{}
+	w.ErrorHandler = func(err error, m *Message, transport string) {
+		mu.Lock()
+		defer mu.Unlock()
+		writerErrors = append(writerErrors, m.Short)
+	}
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Info("first")
+	log.Info("second")
+	hook.Flush()
+
+	mu.Lock()
+	if len(writerErrors) != 2 || len(hookErrors) != 2 {
+		t.Errorf("expected both error handlers to get the 2 messages, got %v and %v", writerErrors, hookErrors)
+	}
+	mu.Unlock()
+	if stats := hook.Stats(); stats.Failed != 2 || stats.Writer.Errors != 2 {
+		t.Errorf("expected 2 failures, got %+v", stats)
+	}
+}
+
+func TestHTTPBatchFlushContext(t *testing.T) {
+	server := newBatchServer(t)
+	defer server.Close()
+	var mu sync.Mutex
+	status := http.StatusServiceUnavailable
+	server.status = func([]byte) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return status
+	}
+
+	hook, err := New(server.URL,
+		WithAsync(),
+		WithWriterOptions(WithHTTPBatch(BatchConfig{Linger: time.Hour})),
+		WithErrorHandler(func(err error, m *Message, transport string) {
+			t.Errorf("unexpected error for %v: %s", m, err)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	hook.Writer().(*HTTPWriter).Backoff = Backoff{Initial: time.Second, Attempts: 4}
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Info("first")
+	log.Info("second")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var flushErr *FlushError
+	if err := hook.FlushContext(ctx); !errors.As(err, &flushErr) || flushErr.Pending != 2 {
+		t.Errorf("FlushContext: expected 2 messages still batched, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("FlushContext should stop with its context, took %s", elapsed)
+	}
+
+	// The messages are kept, and sent once Graylog accepts them
+	mu.Lock()
+	status = http.StatusAccepted
+	mu.Unlock()
+	if err := hook.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if got := server.batches(); len(got) != 1 || len(got[0]) != 2 {
+		t.Errorf("expected the 2 messages to be sent on Close, got %v", got)
+	}
+}
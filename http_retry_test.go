@@ -0,0 +1,235 @@
+package graylog
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var testBackoff = Backoff{Initial: time.Millisecond, Max: 2 * time.Second, Multiplier: 2, Attempts: 3}
+
+// statusServer answers requests with the given statuses in turn, and with
+// the last one once they are exhausted.
+func statusServer(header http.Header, statuses ...int) (*httptest.Server, *int32) {
+	requests := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		n := int(atomic.AddInt32(requests, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+		for key, values := range header {
+			rw.Header()[key] = values
+		}
+		rw.WriteHeader(statuses[n-1])
+	}))
+	return server, requests
+}
+
+func newTestHTTPWriter(t *testing.T, url string) *HTTPWriter {
+	w, err := NewWriter(url)
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	h := w.(*HTTPWriter)
+	h.Backoff = testBackoff
+	return h
+}
+
+func TestHTTPWriterRetry(t *testing.T) {
+	server, requests := statusServer(nil, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusAccepted)
+	defer server.Close()
+
+	w := newTestHTTPWriter(t, server.URL)
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "retried"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if *requests != 3 {
+		t.Errorf("expected 3 requests, got %d", *requests)
+	}
+	if stats := w.Stats(); stats.Retries != 2 || stats.Errors != 0 {
+		t.Errorf("expected 2 retries and no errors, got %+v", stats)
+	}
+}
+
+func TestHTTPWriterRetryBudget(t *testing.T) {
+	server, requests := statusServer(nil, http.StatusBadGateway)
+	defer server.Close()
+
+	w := newTestHTTPWriter(t, server.URL)
+	err := w.WriteMessage(&Message{Version: "1.1", Short: "retried"})
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) || retryErr.Attempts != 3 {
+		t.Fatalf("WriteMessage: expected a RetryError after 3 attempts, got %v", err)
+	}
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusBadGateway {
+		t.Errorf("WriteMessage: expected the last status to be reported, got %v", err)
+	}
+	if *requests != 3 {
+		t.Errorf("expected 3 requests, got %d", *requests)
+	}
+}
+
+func TestHTTPWriterNoRetry(t *testing.T) {
+	server, requests := statusServer(nil, http.StatusBadRequest, http.StatusAccepted)
+	defer server.Close()
+
+	w := newTestHTTPWriter(t, server.URL)
+	err := w.WriteMessage(&Message{Version: "1.1", Short: "rejected"})
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("WriteMessage: expected a 400 error, got %v", err)
+	}
+	if *requests != 1 {
+		t.Errorf("4xx statuses should not be retried, got %d requests", *requests)
+	}
+}
+
+func TestHTTPWriterRetryAfter(t *testing.T) {
+	server, requests := statusServer(http.Header{"Retry-After": {"1"}}, http.StatusTooManyRequests, http.StatusAccepted)
+	defer server.Close()
+
+	w := newTestHTTPWriter(t, server.URL)
+	start := time.Now()
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "throttled"}); err != nil {
+		t.Fatalf("WriteMessage: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected the writer to wait for Retry-After, retried after %s", elapsed)
+	}
+
+	// Delays longer than the backoff allows are not waited for
+	server, requests = statusServer(http.Header{"Retry-After": {"3600"}}, http.StatusServiceUnavailable, http.StatusAccepted)
+	defer server.Close()
+
+	w = newTestHTTPWriter(t, server.URL)
+	err := w.WriteMessage(&Message{Version: "1.1", Short: "throttled"})
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RetryAfter != time.Hour {
+		t.Errorf("WriteMessage: expected a 503 error with Retry-After, got %v", err)
+	}
+	if *requests != 1 {
+		t.Errorf("expected 1 request, got %d", *requests)
+	}
+}
+
+func TestHTTPWriterRetryTransportError(t *testing.T) {
+	server, _ := statusServer(nil, http.StatusAccepted)
+	server.Close()
+
+	transport := new(countingTransport)
+	w, err := NewWriter(server.URL, WithRoundTripper(transport))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w.(*HTTPWriter).Backoff = testBackoff
+	var retryErr *RetryError
+	if err := w.WriteMessage(&Message{Version: "1.1", Short: "unreachable"}); !errors.As(err, &retryErr) {
+		t.Errorf("WriteMessage: expected a RetryError, got %v", err)
+	}
+	if transport.requests != 3 {
+		t.Errorf("expected 3 requests, got %d", transport.requests)
+	}
+}
+
+func TestHTTPWriterNoRetryTLSError(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	// The certificate of the server is not trusted
+	transport := new(countingTransport)
+	w, err := NewWriter(server.URL, WithRoundTripper(transport))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w.(*HTTPWriter).Backoff = Backoff{Initial: time.Second, Attempts: 3}
+	start := time.Now()
+	err = w.WriteMessage(&Message{Version: "1.1", Short: "untrusted"})
+	var retryErr *RetryError
+	if err == nil || errors.As(err, &retryErr) {
+		t.Errorf("WriteMessage: expected a certificate error without retries, got %v", err)
+	}
+	if transport.requests != 1 || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expected to fail fast, got %d requests in %s", transport.requests, time.Since(start))
+	}
+}
+
+func TestHTTPWriterCloseDuringRetry(t *testing.T) {
+	server, _ := statusServer(nil, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	w := newTestHTTPWriter(t, server.URL)
+	w.Backoff = Backoff{Initial: time.Hour, Attempts: 2}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		w.Close()
+	}()
+
+	done := make(chan error)
+	go func() {
+		done <- w.WriteMessage(&Message{Version: "1.1", Short: "interrupted"})
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("WriteMessage should fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close should interrupt retries")
+	}
+}
+
+func TestHTTPRetryErrorHandler(t *testing.T) {
+	server, _ := statusServer(nil, http.StatusInternalServerError)
+	defer server.Close()
+
+	errs := make(chan error, 1)
+	hook, err := New(server.URL, WithErrorHandler(func(err error, m *Message, transport string) {
+		errs <- err
+	}))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	hook.Writer().(*HTTPWriter).Backoff = testBackoff
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Error("lost")
+
+	var retryErr *RetryError
+	if err := <-errs; !errors.As(err, &retryErr) || retryErr.Attempts != 3 {
+		t.Errorf("expected the error handler to get a RetryError after 3 attempts, got %v", err)
+	}
+	if stats := hook.Stats(); stats.Writer == nil || stats.Writer.Retries != 2 {
+		t.Errorf("expected 2 retries in the hook stats, got %+v", stats.Writer)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"Wed, 01 Jan 2020 00:00:30 GMT", 30 * time.Second},
+		{"Tue, 31 Dec 2019 23:59:00 GMT", 0},
+		{"soon", 0},
+	}
+	for _, test := range tests {
+		if got := parseRetryAfter(test.value, now); got != test.expected {
+			t.Errorf("parseRetryAfter(%q): expected %s, got %s", test.value, test.expected, got)
+		}
+	}
+}
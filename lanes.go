@@ -0,0 +1,86 @@
+package graylog
+
+import (
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Lane configures the queue of the entries of a band of levels, for
+// WithLanes. Workers and ShardField are ignored: the workers set by
+// WithQueue are shared by all the lanes.
+type Lane struct {
+	Level logrus.Level // least severe level of the lane
+	Queue QueueConfig  // size and overflow policy of the lane
+}
+
+// lane is the queue of the entries of a band of levels.
+type lane struct {
+	level  logrus.Level
+	config QueueConfig
+	buf    chan graylogEntry
+}
+
+// newLanes creates the lanes of an asynchronous hook, most severe first.
+// Without WithLanes, a single lane holds the entries of all the levels.
+func (hook *GraylogHook) newLanes() []*lane {
+	config := hook.laneConfig
+	if len(config) == 0 {
+		config = []Lane{{Level: logrus.TraceLevel, Queue: hook.queue}}
+	}
+	lanes := make([]*lane, len(config))
+	for i, c := range config {
+		lanes[i] = &lane{
+			level:  c.Level,
+			config: c.Queue,
+			buf:    make(chan graylogEntry, c.Queue.Size),
+		}
+	}
+	return lanes
+}
+
+// laneOf returns the lane of the entries of a level.
+func (hook *GraylogHook) laneOf(level logrus.Level) *lane {
+	for _, l := range hook.lanes {
+		if level <= l.level {
+			return l
+		}
+	}
+	return hook.lanes[len(hook.lanes)-1]
+}
+
+// next returns an entry of the most severe lane holding one, waiting for
+// an entry if all the lanes are empty. It returns false once the lanes are
+// closed.
+func (hook *GraylogHook) next() (graylogEntry, bool) {
+	for _, l := range hook.lanes {
+		select {
+		case entry, ok := <-l.buf:
+			return entry, ok
+		default:
+		}
+	}
+	if len(hook.lanes) == 1 {
+		entry, ok := <-hook.lanes[0].buf
+		return entry, ok
+	}
+
+	cases := make([]reflect.SelectCase, len(hook.lanes))
+	for i, l := range hook.lanes {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(l.buf)}
+	}
+	_, v, ok := reflect.Select(cases)
+	if !ok {
+		return graylogEntry{}, false
+	}
+	return v.Interface().(graylogEntry), true
+}
+
+// depth returns the number of entries in the lanes.
+func (hook *GraylogHook) depth() int {
+	depth := 0
+	for _, l := range hook.lanes {
+		depth += len(l.buf)
+	}
+	return depth
+}
@@ -0,0 +1,112 @@
+package graylog
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLanesPriority(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook, err := New(r.Addr(), WithLanes(
+		Lane{Level: logrus.DebugLevel, Queue: QueueConfig{Size: 10}},
+		Lane{Level: logrus.WarnLevel, Queue: QueueConfig{Size: 10}},
+	))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	defer hook.Close()
+	w := &blockingWriter{release: make(chan struct{}), received: make(chan *Message, 10)}
+	hook.setWriter(w)
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.SetLevel(logrus.DebugLevel)
+	log.Hooks.Add(hook)
+
+	log.Debug("first")
+	<-w.received // "first" is being written, the lanes are empty
+	log.Debug("second")
+	log.Info("third")
+	log.Error("fourth")
+	log.Warn("fifth")
+
+	close(w.release)
+	hook.Flush()
+	close(w.received)
+	var got []string
+	for m := range w.received {
+		got = append(got, m.Short)
+	}
+	expected := []string{"fourth", "fifth", "second", "third"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestLanesOverflow(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook, err := New(r.Addr(), WithLanes(
+		Lane{Level: logrus.ErrorLevel, Queue: QueueConfig{Size: 5}},
+		Lane{Level: logrus.TraceLevel, Queue: QueueConfig{Size: 1, Overflow: OverflowDropNewest}},
+	))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	defer hook.Close()
+	w := &blockingWriter{release: make(chan struct{}), received: make(chan *Message, 10)}
+	hook.setWriter(w)
+	hook.ErrorHandler = func(err error, m *Message, transport string) {}
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+
+	log.Info("first")
+	<-w.received
+	for i := 0; i < 3; i++ {
+		log.Info("info")
+		log.Error("error")
+	}
+	if stats := hook.Stats(); stats.QueueDepth != 4 {
+		t.Errorf("expected a queue depth of 4, got %d", stats.QueueDepth)
+	}
+
+	close(w.release)
+	hook.Flush()
+	if hook.Dropped() != 2 {
+		t.Errorf("expected 2 dropped info entries, got %d", hook.Dropped())
+	}
+	close(w.received)
+	errors := 0
+	for m := range w.received {
+		if m.Short == "error" {
+			errors++
+		}
+	}
+	if errors != 3 {
+		t.Errorf("expected 3 errors sent, got %d", errors)
+	}
+}
+
+func TestWithLanesErrors(t *testing.T) {
+	tests := [][]Lane{
+		nil,
+		{{Level: logrus.TraceLevel + 1}},
+		{{Level: logrus.ErrorLevel}, {Level: logrus.ErrorLevel}},
+		{{Level: logrus.ErrorLevel, Queue: QueueConfig{Overflow: OverflowBlockTimeout}}},
+	}
+	for _, lanes := range tests {
+		if _, err := New("127.0.0.1:12201", WithLanes(lanes...)); err == nil {
+			t.Errorf("expected an error for lanes %+v", lanes)
+		}
+	}
+}
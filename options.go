@@ -0,0 +1,242 @@
+package graylog
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Option configures a hook created by New.
+type Option func(*GraylogHook) error
+
+// WithAsync makes the hook asynchronous, with a queue of BufSize entries.
+// It's the responsibility of the user to call the Flush or Close method
+// before exiting to empty the log queue.
+func WithAsync() Option {
+	return WithQueue(QueueConfig{Size: BufSize})
+}
+
+// WithQueue makes the hook asynchronous, with the given queue size and
+// overflow policy.
+func WithQueue(queue QueueConfig) Option {
+	return func(hook *GraylogHook) error {
+		if err := queue.validate(); err != nil {
+			return err
+		}
+		if queue.Workers < 0 {
+			return fmt.Errorf("graylog: invalid number of workers %d", queue.Workers)
+		}
+		hook.synchronous = false
+		hook.queue = queue
+		return nil
+	}
+}
+
+// WithLanes makes the hook asynchronous, with a queue per band of levels.
+// An entry goes to the first lane whose Level is at least as severe as
+// its own, or to the last lane, and the entries of more severe lanes are
+// always sent first. Each lane has its own size and overflow policy, while
+// the workers set by WithQueue are shared by all the lanes.
+func WithLanes(lanes ...Lane) Option {
+	return func(hook *GraylogHook) error {
+		if len(lanes) == 0 {
+			return errors.New("graylog: no lanes")
+		}
+		lanes = append([]Lane(nil), lanes...)
+		sort.SliceStable(lanes, func(i, j int) bool { return lanes[i].Level < lanes[j].Level })
+		for i, lane := range lanes {
+			if lane.Level > logrus.TraceLevel {
+				return fmt.Errorf("graylog: unknown level %d", lane.Level)
+			}
+			if i > 0 && lane.Level == lanes[i-1].Level {
+				return fmt.Errorf("graylog: several lanes for level %s", lane.Level)
+			}
+			if err := lane.Queue.validate(); err != nil {
+				return err
+			}
+		}
+		hook.synchronous = false
+		hook.laneConfig = lanes
+		return nil
+	}
+}
+
+// WithExtra sets global fields included in all the messages.
+func WithExtra(extra map[string]interface{}) Option {
+	return func(hook *GraylogHook) error {
+		hook.Extra = extra
+		return nil
+	}
+}
+
+// WithLevel sets the lowest level sent to Graylog. Defaults to
+// logrus.DebugLevel.
+func WithLevel(level logrus.Level) Option {
+	return func(hook *GraylogHook) error {
+		if level > logrus.TraceLevel {
+			return fmt.Errorf("graylog: unknown level %d", level)
+		}
+		hook.Level = level
+		return nil
+	}
+}
+
+// WithHost sets the host of the messages, instead of os.Hostname.
+func WithHost(host string) Option {
+	return func(hook *GraylogHook) error {
+		hook.Host = host
+		return nil
+	}
+}
+
+// WithFacility sets the facility of the messages.
+func WithFacility(facility string) Option {
+	return func(hook *GraylogHook) error {
+		hook.Facility = facility
+		return nil
+	}
+}
+
+// WithBlacklist filters out the given fields of the entries.
+// See GraylogHook.Blacklist.
+func WithBlacklist(fields []string) Option {
+	return func(hook *GraylogHook) error {
+		hook.Blacklist(fields)
+		return nil
+	}
+}
+
+// WithCompression sets the compression of UDP and HTTP messages, TCP
+// messages are never compressed. level is one of the consts from
+// compress/flate.
+func WithCompression(compressionType CompressType, level int) Option {
+	return func(hook *GraylogHook) error {
+		switch compressionType {
+		case CompressGzip, CompressZlib, NoCompress:
+		default:
+			return fmt.Errorf("graylog: unknown compression type %d", compressionType)
+		}
+		if level < flate.HuffmanOnly || level > flate.BestCompression {
+			return fmt.Errorf("graylog: invalid compression level %d", level)
+		}
+		hook.writerOpts = append(hook.writerOpts, func(c *writerConfig) {
+			c.compression = &compression{compressionType, level}
+		})
+		return nil
+	}
+}
+
+// WithWriterOptions sets the options of the writer created by the hook.
+func WithWriterOptions(opts ...WriterOption) Option {
+	return func(hook *GraylogHook) error {
+		hook.writerOpts = append(hook.writerOpts, opts...)
+		return nil
+	}
+}
+
+// WithFailover makes the hook send messages to the first healthy address
+// among addr and addrs, in order, with a FailoverWriter.
+func WithFailover(addrs ...string) Option {
+	return func(hook *GraylogHook) error {
+		if len(hook.balance) > 0 {
+			return errors.New("graylog: WithFailover can't be used with WithBalancing")
+		}
+		hook.failover = append(hook.failover, addrs...)
+		return nil
+	}
+}
+
+// WithBalancing makes the hook spread messages across addr and addrs with
+// a BalancingWriter.
+func WithBalancing(addrs ...string) Option {
+	return func(hook *GraylogHook) error {
+		if len(hook.failover) > 0 {
+			return errors.New("graylog: WithBalancing can't be used with WithFailover")
+		}
+		hook.balance = append(hook.balance, addrs...)
+		return nil
+	}
+}
+
+// WithLazyConnect makes the hook usable even if its writer can't be created
+// yet, for example because Graylog can't be resolved or reached. The hook
+// keeps trying to create its writer in background, and keeps up to
+// PendingLimit messages in the meantime.
+func WithLazyConnect() Option {
+	return func(hook *GraylogHook) error {
+		hook.lazy = true
+		return nil
+	}
+}
+
+// WithPendingLimit sets the number of messages kept while a lazily
+// connected hook is not connected yet.
+func WithPendingLimit(limit int) Option {
+	return func(hook *GraylogHook) error {
+		hook.PendingLimit = limit
+		return nil
+	}
+}
+
+// WithErrorHandler sets the function called with the messages that can't
+// be sent to Graylog. See GraylogHook.ErrorHandler.
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(hook *GraylogHook) error {
+		if handler == nil {
+			return errors.New("graylog: error handler can't be nil")
+		}
+		hook.ErrorHandler = handler
+		return nil
+	}
+}
+
+// WithReturnErrors makes Fire return the errors of synchronous hooks.
+// See GraylogHook.ReturnErrors.
+func WithReturnErrors() Option {
+	return func(hook *GraylogHook) error {
+		hook.ReturnErrors = true
+		return nil
+	}
+}
+
+// WithSpool keeps the messages which can't be sent to Graylog, or which
+// don't fit in the queue of an asynchronous hook, in a disk spool. They are
+// sent once Graylog can be reached again.
+func WithSpool(config SpoolConfig) Option {
+	return func(hook *GraylogHook) error {
+		s, err := openSpool(config)
+		if err != nil {
+			return err
+		}
+		hook.spool = s
+		return nil
+	}
+}
+
+// WithTimestampPrecision sets the precision of the GELF timestamps, such as
+// time.Millisecond (the default) or time.Microsecond.
+func WithTimestampPrecision(precision time.Duration) Option {
+	return func(hook *GraylogHook) error {
+		if precision <= 0 || precision > time.Second || time.Second%precision != 0 {
+			return fmt.Errorf("graylog: invalid timestamp precision %s", precision)
+		}
+		hook.TimestampPrecision = precision
+		return nil
+	}
+}
+
+// WithClock sets the function returning the time of the entries without
+// one. Defaults to time.Now.
+func WithClock(clock func() time.Time) Option {
+	return func(hook *GraylogHook) error {
+		if clock == nil {
+			return errors.New("graylog: clock can't be nil")
+		}
+		hook.Clock = clock
+		return nil
+	}
+}
@@ -0,0 +1,100 @@
+package graylog
+
+import (
+	"compress/flate"
+	"io"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestNew(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook, err := New(r.Addr(),
+		WithAsync(),
+		WithExtra(map[string]interface{}{"foo": "bar"}),
+		WithHost("testing.local"),
+		WithFacility("tests"),
+		WithLevel(logrus.InfoLevel),
+		WithBlacklist([]string{"filterMe"}),
+		WithCompression(CompressZlib, flate.BestSpeed),
+	)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	defer hook.Close()
+
+	if hook.synchronous {
+		t.Error("hook should be asynchronous")
+	}
+	if w := hook.Writer().(*LowLevelProtocolWriter); w.CompressionType != CompressZlib || w.CompressionLevel != flate.BestSpeed {
+		t.Errorf("Compression: expected %d/%d, got %d/%d", CompressZlib, flate.BestSpeed, w.CompressionType, w.CompressionLevel)
+	}
+
+	log := logrus.New()
+	log.SetLevel(logrus.DebugLevel)
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Debug("filtered by level")
+	log.WithFields(logrus.Fields{"withField": "1", "filterMe": "1"}).Info("test message")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != "test message" {
+		t.Errorf("msg.Short: expected %s, got %s", "test message", msg.Short)
+	}
+	if msg.Host != "testing.local" {
+		t.Errorf("msg.Host: expected %s, got %s", "testing.local", msg.Host)
+	}
+	if msg.Facility != "tests" {
+		t.Errorf("msg.Facility: expected %s, got %s", "tests", msg.Facility)
+	}
+	if msg.Extra["_foo"] != "bar" || msg.Extra["_withField"] != "1" {
+		t.Errorf("unexpected extra fields %v", msg.Extra)
+	}
+	if _, ok := msg.Extra["_filterMe"]; ok {
+		t.Error("_filterMe should be blacklisted")
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	listener, err := NewTCPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewTCPReader: %s", err)
+	}
+	addr := "tcp://" + listener.Addr().String()
+	listener.Close()
+
+	if _, err := New(addr); err == nil {
+		t.Error("New should fail when Graylog can't be reached")
+	}
+
+	logrus.SetOutput(io.Discard)
+	hook, err := New(addr, WithLazyConnect())
+	if err != nil {
+		t.Errorf("New with lazy connection: %s", err)
+	} else {
+		hook.Close()
+	}
+
+	invalid := []Option{
+		WithCompression(CompressType(42), flate.BestSpeed),
+		WithCompression(CompressGzip, 42),
+		WithLevel(logrus.Level(42)),
+		WithQueue(QueueConfig{Size: 1, Overflow: OverflowBlockTimeout}),
+	}
+	for i, opt := range invalid {
+		if _, err := New("127.0.0.1:12201", opt); err == nil {
+			t.Errorf("option %d should be invalid", i)
+		}
+	}
+
+	if _, err := New("127.0.0.1:12201", WithFailover("127.0.0.1:12202"), WithBalancing("127.0.0.1:12203")); err == nil {
+		t.Error("WithFailover and WithBalancing should not be usable together")
+	}
+}
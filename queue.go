@@ -0,0 +1,168 @@
+package graylog
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy tells what an asynchronous hook does with an entry fired
+// while its queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the logging goroutine until the queue has room.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the entry being fired.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest queued entry to make room for
+	// the entry being fired.
+	OverflowDropOldest
+	// OverflowBlockTimeout blocks the logging goroutine until the queue
+	// has room, for at most QueueConfig.Timeout. The entry being fired is
+	// dropped after that.
+	OverflowBlockTimeout
+)
+
+// QueueConfig configures the queue of an asynchronous hook.
+//
+// Entries are sent by Workers goroutines, which send entries concurrently
+// and so possibly out of order. When ShardField is set, the entries with
+// the same value of this field, such as the entries of a request, are all
+// sent in order by the same worker.
+type QueueConfig struct {
+	Size       uint           // number of entries the queue can hold
+	Overflow   OverflowPolicy // what to do with entries fired while the queue is full
+	Timeout    time.Duration  // maximum wait of OverflowBlockTimeout
+	Workers    int            // goroutines sending entries, defaults to one
+	ShardField string         // field whose entries are sent in order by the same worker
+}
+
+func (q QueueConfig) validate() error {
+	if q.Overflow < OverflowBlock || q.Overflow > OverflowBlockTimeout {
+		return fmt.Errorf("graylog: unknown overflow policy %d", q.Overflow)
+	}
+	if q.Overflow == OverflowBlockTimeout && q.Timeout <= 0 {
+		return errors.New("graylog: OverflowBlockTimeout requires a positive timeout")
+	}
+	return nil
+}
+
+// withDefaults replaces the invalid settings of q: unknown overflow
+// policies block, and OverflowBlockTimeout without timeout drops the
+// newest entry.
+func (q QueueConfig) withDefaults() QueueConfig {
+	if q.Overflow < OverflowBlock || q.Overflow > OverflowBlockTimeout {
+		q.Overflow = OverflowBlock
+	}
+	if q.Overflow == OverflowBlockTimeout && q.Timeout <= 0 {
+		q.Overflow = OverflowDropNewest
+	}
+	if q.Workers < 0 {
+		q.Workers = 0
+	}
+	return q
+}
+
+func (q QueueConfig) workers() int {
+	if q.Workers <= 0 {
+		return 1
+	}
+	return q.Workers
+}
+
+// enqueue adds an entry to the lane of its level, applying the overflow
+// policy of the lane if it is full.
+func (hook *GraylogHook) enqueue(entry graylogEntry) {
+	hook.wg.Add(1)
+	atomic.AddInt64(&hook.queued, 1)
+	defer func() { hook.stats.observeDepth(hook.depth()) }()
+
+	l := hook.laneOf(entry.Level)
+	switch l.config.Overflow {
+	case OverflowDropNewest:
+		select {
+		case l.buf <- entry:
+		default:
+			hook.drop(entry)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case l.buf <- entry:
+				return
+			default:
+			}
+			select {
+			case old := <-l.buf:
+				hook.drop(old)
+			default:
+			}
+		}
+	case OverflowBlockTimeout:
+		select {
+		case l.buf <- entry:
+			return
+		default:
+		}
+		timer := time.NewTimer(l.config.Timeout)
+		defer timer.Stop()
+		select {
+		case l.buf <- entry:
+		case <-timer.C:
+			hook.drop(entry)
+		}
+	default:
+		l.buf <- entry
+	}
+}
+
+// work sends entries until next reports there are no more.
+func (hook *GraylogHook) work(next func() (graylogEntry, bool)) {
+	for {
+		entry, ok := next()
+		if !ok {
+			return
+		}
+		if err := hook.sendEntry(entry); err != nil {
+			hook.lose(err, nil)
+		}
+		hook.done()
+	}
+}
+
+// receive returns a function receiving the entries of a channel, for work.
+func receive(entries <-chan graylogEntry) func() (graylogEntry, bool) {
+	return func() (graylogEntry, bool) {
+		entry, ok := <-entries
+		return entry, ok
+	}
+}
+
+// shard returns the worker of an entry, selected by the value of its
+// ShardField, or in turn for the entries without this field.
+func (hook *GraylogHook) shard(entry graylogEntry, next *uint32, workers int) int {
+	v, ok := entry.Data[hook.queue.ShardField]
+	if !ok {
+		*next++
+		return int(*next % uint32(workers))
+	}
+	h := fnv.New32a()
+	fmt.Fprint(h, v)
+	return int(h.Sum32() % uint32(workers))
+}
+
+// drop discards an entry that was counted as queued.
+func (hook *GraylogHook) drop(entry graylogEntry) {
+	atomic.AddUint64(&hook.dropped, 1)
+	hook.done()
+	hook.lose(ErrQueueFull, hook.newMessage(entry))
+}
+
+// Dropped returns the number of entries dropped because the queue of the
+// hook was full.
+func (hook *GraylogHook) Dropped() uint64 {
+	return atomic.LoadUint64(&hook.dropped)
+}
@@ -0,0 +1,75 @@
+package graylog
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// resolveLoop resolves the address of a UDP writer every resolveInterval,
+// until the writer is closed.
+func (w *LowLevelProtocolWriter) resolveLoop() {
+	ticker := time.NewTicker(w.resolveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.resolve()
+		}
+	}
+}
+
+// observeWrite counts the consecutive failed writes of a UDP writer, and
+// resolves its address again in background once resolveAfterErrors is
+// reached. w.mu must be held.
+func (w *LowLevelProtocolWriter) observeWrite(err error) {
+	if w.protocol != "udp" || w.resolveAfterErrors <= 0 {
+		return
+	}
+	if err == nil {
+		w.writeErrors = 0
+		return
+	}
+	w.writeErrors++
+	if w.writeErrors >= w.resolveAfterErrors {
+		w.writeErrors = 0
+		go w.resolve()
+	}
+}
+
+// resolve dials the address of the writer again, which resolves its host
+// name, and swaps the connection if the address changed. Dialing is done
+// without holding w.mu, so that messages keep being written to the
+// previous connection in the meantime.
+func (w *LowLevelProtocolWriter) resolve() {
+	if !atomic.CompareAndSwapInt32(&w.resolving, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&w.resolving, 0)
+
+	conn, err := w.dial()
+	if err != nil {
+		if w.ErrorHandler != nil {
+			w.ErrorHandler(fmt.Errorf("can't resolve %s: %w", w.addr, err), nil, w.protocol)
+		}
+		return
+	}
+
+	w.mu.Lock()
+	if w.isClosed() || w.conn != nil && w.conn.RemoteAddr().String() == conn.RemoteAddr().String() {
+		w.mu.Unlock()
+		conn.Close()
+		return
+	}
+	old := w.conn
+	w.conn = conn
+	w.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	atomic.AddUint64(&w.stats.reconnects, 1)
+}
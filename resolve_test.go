@@ -0,0 +1,187 @@
+package graylog
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dnsServer answers the A queries of a resolver with its current address,
+// and the other queries with no answer.
+type dnsServer struct {
+	conn net.PacketConn
+
+	mu sync.Mutex
+	ip net.IP
+}
+
+func newDNSServer(t *testing.T, ip string) *dnsServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s := &dnsServer{conn: conn}
+	s.set(ip)
+	go s.serve()
+	return s
+}
+
+// set makes the server answer with ip from now on.
+func (s *dnsServer) set(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ip = net.ParseIP(ip).To4()
+}
+
+func (s *dnsServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.answer(buf[:n]); resp != nil {
+			s.conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// answer builds the response to a query, made of its header and question
+// followed by the answer, if any.
+func (s *dnsServer) answer(query []byte) []byte {
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1 // skip the labels of the name
+	}
+	end += 5 // null label, type and class
+	if end > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+
+	resp := append([]byte(nil), query[:end]...)
+	resp[2], resp[3] = 0x81, 0x80 // response, recursion available, no error
+	for i := 6; i < 12; i++ {
+		resp[i] = 0 // no answer, authority nor additional records
+	}
+	if qtype == 1 {
+		s.mu.Lock()
+		ip := s.ip
+		s.mu.Unlock()
+		resp[7] = 1
+		resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4)
+		resp = append(resp, ip...)
+	}
+	return resp
+}
+
+func (s *dnsServer) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", s.conn.LocalAddr().String())
+		},
+	}
+}
+
+// newUDPReaders listens on the same port of two loopback addresses, which
+// stand for the addresses of Graylog before and after it moved.
+func newUDPReaders(t *testing.T) (before, after *Reader, port string) {
+	before, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	_, port, _ = net.SplitHostPort(before.Addr())
+	after, err = NewUDPReader(net.JoinHostPort("127.0.0.2", port))
+	if err != nil {
+		t.Skipf("can't listen on a second loopback address: %s", err)
+	}
+	return before, after, port
+}
+
+func waitReconnects(t *testing.T, w *LowLevelProtocolWriter, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for w.Stats().Reconnects < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d reconnects, got %d", n, w.Stats().Reconnects)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func expectUDP(t *testing.T, r *Reader, short string) {
+	t.Helper()
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	if msg.Short != short {
+		t.Errorf("msg.Short: expected %s, got %s", short, msg.Short)
+	}
+}
+
+func TestResolveInterval(t *testing.T) {
+	before, after, port := newUDPReaders(t)
+	dns := newDNSServer(t, "127.0.0.1")
+
+	g, err := NewWriter(net.JoinHostPort("graylog.test", port),
+		WithResolver(dns.resolver()), WithResolveInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w := g.(*LowLevelProtocolWriter)
+	defer w.Close()
+	writeShorts(t, w, "before")
+	expectUDP(t, before, "before")
+
+	// The address is resolved again every 10ms, and followed once changed
+	dns.set("127.0.0.2")
+	waitReconnects(t, w, 1)
+
+	writeShorts(t, w, "after")
+	expectUDP(t, after, "after")
+}
+
+func TestResolveAfterErrors(t *testing.T) {
+	_, after, port := newUDPReaders(t)
+	dns := newDNSServer(t, "127.0.0.1")
+
+	g, err := NewWriter(net.JoinHostPort("graylog.test", port),
+		WithResolver(dns.resolver()), WithResolveAfterErrors(2))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	w := g.(*LowLevelProtocolWriter)
+	defer w.Close()
+
+	// The address is not resolved again while the address doesn't change
+	w.resolve()
+	if reconnects := w.Stats().Reconnects; reconnects != 0 {
+		t.Errorf("expected no reconnect, got %d", reconnects)
+	}
+
+	dns.set("127.0.0.2")
+	w.mu.Lock()
+	w.observeWrite(errWriteFailed)
+	w.observeWrite(nil)
+	w.observeWrite(errWriteFailed)
+	w.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	if reconnects := w.Stats().Reconnects; reconnects != 0 {
+		t.Errorf("errors are not consecutive, expected no reconnect, got %d", reconnects)
+	}
+
+	w.mu.Lock()
+	w.observeWrite(errWriteFailed)
+	w.mu.Unlock()
+	waitReconnects(t, w, 1)
+
+	writeShorts(t, w, "after")
+	expectUDP(t, after, "after")
+}
@@ -0,0 +1,376 @@
+package graylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SyncPolicy tells when spooled messages are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = iota
+	// SyncAlways flushes every spooled message before returning.
+	SyncAlways
+	// SyncInterval flushes spooled messages every SpoolConfig.SyncInterval.
+	SyncInterval
+)
+
+// SpoolConfig configures the disk spool of a hook. Messages which can't be
+// sent to Graylog, or which don't fit in the queue of an asynchronous hook,
+// are appended to segment files in Dir. Segments are replayed in order once
+// messages can be sent again, and removed once replayed.
+// Messages are delivered at least once: a segment partially replayed when
+// the process stops is replayed entirely on the next start.
+type SpoolConfig struct {
+	Dir            string
+	MaxSegmentSize int64         // size of a segment file, defaults to 16MiB, at most a quarter of MaxSize
+	MaxSize        int64         // total size of the spool, 0 means unlimited
+	MaxAge         time.Duration // age of the oldest segment kept, 0 means unlimited
+	Sync           SyncPolicy
+	SyncInterval   time.Duration // defaults to one second
+	ReplayInterval time.Duration // delay between replay attempts, defaults to one second
+}
+
+const (
+	defaultSegmentSize    = 16 << 20
+	defaultSpoolInterval  = time.Second
+	spoolSegmentExtension = ".gelf"
+)
+
+// ErrSpoolLimit is passed to error handlers when spooled messages are
+// removed to respect SpoolConfig.MaxSize or SpoolConfig.MaxAge.
+var ErrSpoolLimit = errors.New("graylog: spool limit reached")
+
+// spool stores messages in segment files, named after their sequence
+// number so that their lexical order is their creation order.
+type spool struct {
+	config SpoolConfig
+
+	mu       sync.Mutex
+	segments []string  // closed segments, oldest first
+	active   *os.File  // segment messages are appended to, if any
+	size     int64     // size of the active segment
+	total    int64     // size of all the segments
+	next     uint64    // sequence number of the next segment
+	dirty    bool      // the active segment has unsynced writes
+	opened   time.Time // creation time of the active segment
+
+	replayMu     sync.Mutex // serializes replays
+	replayOffset int64      // offset of the next message of the oldest segment
+}
+
+func openSpool(config SpoolConfig) (*spool, error) {
+	if config.Dir == "" {
+		return nil, errors.New("graylog: spool directory can't be empty")
+	}
+	if config.MaxSegmentSize <= 0 {
+		config.MaxSegmentSize = defaultSegmentSize
+	}
+	// Only closed segments are removed to respect MaxSize, so segments are
+	// kept small enough to be closed and removed while the spool grows.
+	if config.MaxSize > 0 && config.MaxSegmentSize > config.MaxSize/4 {
+		config.MaxSegmentSize = config.MaxSize / 4
+		if config.MaxSegmentSize < 1 {
+			config.MaxSegmentSize = 1
+		}
+	}
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = defaultSpoolInterval
+	}
+	if config.ReplayInterval <= 0 {
+		config.ReplayInterval = defaultSpoolInterval
+	}
+	if err := os.MkdirAll(config.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("graylog: can't create spool: %w", err)
+	}
+
+	s := &spool{config: config}
+
+	// Segments left by a previous process are replayed first
+	entries, err := os.ReadDir(config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("graylog: can't read spool: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentExtension), 10, 64)
+		if entry.IsDir() || !strings.HasSuffix(name, spoolSegmentExtension) || err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("graylog: can't read spool: %w", err)
+		}
+		s.segments = append(s.segments, name)
+		s.total += info.Size()
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+	}
+	sort.Strings(s.segments)
+
+	return s, nil
+}
+
+// append writes m to the active segment, creating it if needed. Segments
+// removed to respect the size and age limits are returned.
+func (s *spool) append(m *Message) (removed []string, err error) {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Only closed segments are removed to respect MaxAge, so the active
+	// segment is closed once it gets as old.
+	tooOld := s.config.MaxAge > 0 && time.Since(s.opened) > s.config.MaxAge
+	if s.active != nil && (s.size+int64(len(line)) > s.config.MaxSegmentSize || tooOld) {
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	if s.active == nil {
+		name := filepath.Join(s.config.Dir, fmt.Sprintf("%020d%s", s.next, spoolSegmentExtension))
+		if s.active, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err != nil {
+			return nil, err
+		}
+		s.next++
+		s.opened = time.Now()
+		s.size = 0
+	}
+
+	n, err := s.active.Write(line)
+	s.size += int64(n)
+	s.total += int64(n)
+	if err != nil {
+		return nil, err
+	}
+	s.dirty = true
+	if s.config.Sync == SyncAlways {
+		if err := s.sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.enforceLimits(), nil
+}
+
+// rotate closes the active segment, making it available for replay.
+func (s *spool) rotate() error {
+	if s.active == nil {
+		return nil
+	}
+	err := s.sync()
+	if cerr := s.active.Close(); err == nil {
+		err = cerr
+	}
+	s.segments = append(s.segments, filepath.Base(s.active.Name()))
+	s.active = nil
+	return err
+}
+
+func (s *spool) sync() error {
+	if s.active == nil || !s.dirty {
+		return nil
+	}
+	s.dirty = false
+	return s.active.Sync()
+}
+
+// enforceLimits removes the oldest closed segments until the spool
+// respects its size and age limits.
+func (s *spool) enforceLimits() (removed []string) {
+	for len(s.segments) > 0 {
+		path := filepath.Join(s.config.Dir, s.segments[0])
+		info, err := os.Stat(path)
+		if err != nil {
+			// Removed by a replay in the meantime
+			s.segments = s.segments[1:]
+			continue
+		}
+		tooBig := s.config.MaxSize > 0 && s.total > s.config.MaxSize
+		tooOld := s.config.MaxAge > 0 && time.Since(info.ModTime()) > s.config.MaxAge
+		if !tooBig && !tooOld {
+			break
+		}
+		os.Remove(path)
+		s.segments = s.segments[1:]
+		s.total -= info.Size()
+		s.replayOffset = 0
+		removed = append(removed, path)
+	}
+	return removed
+}
+
+// empty reports whether there is nothing to replay.
+func (s *spool) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.segments) == 0 && (s.active == nil || s.size == 0)
+}
+
+// replay writes the spooled messages with w, oldest first, and removes
+// the segments once written. It stops at the first message which can't be
+// written, and returns its error.
+func (s *spool) replay(w GELFWriter) error {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	for {
+		s.mu.Lock()
+		if len(s.segments) == 0 {
+			// Make the messages appended so far available for replay
+			if err := s.rotate(); err != nil {
+				s.mu.Unlock()
+				return err
+			}
+		}
+		if len(s.segments) == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		name := s.segments[0]
+		offset := s.replayOffset
+		s.mu.Unlock()
+
+		offset, err := s.replaySegment(w, filepath.Join(s.config.Dir, name), offset)
+
+		s.mu.Lock()
+		if len(s.segments) > 0 && s.segments[0] == name {
+			if err != nil {
+				s.replayOffset = offset
+			} else {
+				if info, serr := os.Stat(filepath.Join(s.config.Dir, name)); serr == nil {
+					s.total -= info.Size()
+				}
+				os.Remove(filepath.Join(s.config.Dir, name))
+				s.segments = s.segments[1:]
+				s.replayOffset = 0
+			}
+		}
+		s.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// replaySegment writes the messages of a segment starting at offset, and
+// returns the offset of the first message not written.
+func (s *spool) replaySegment(w GELFWriter, path string, offset int64) (int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Removed to respect the spool limits
+		return offset, nil
+	}
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A truncated last line is skipped
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		m := new(Message)
+		if err := json.Unmarshal(line, m); err == nil {
+			if err := w.WriteMessage(m); err != nil {
+				return offset, err
+			}
+		}
+		offset += int64(len(line))
+	}
+}
+
+// close syncs and closes the active segment.
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rotate()
+}
+
+// spoolLoop replays the spool of a hook every ReplayInterval, and syncs it
+// every SyncInterval if needed, until the hook is closed.
+func (hook *GraylogHook) spoolLoop() {
+	defer close(hook.spoolDone)
+
+	replay := time.NewTicker(hook.spool.config.ReplayInterval)
+	defer replay.Stop()
+	var sync <-chan time.Time
+	if hook.spool.config.Sync == SyncInterval {
+		ticker := time.NewTicker(hook.spool.config.SyncInterval)
+		defer ticker.Stop()
+		sync = ticker.C
+	}
+
+	for {
+		select {
+		case <-hook.quit:
+			return
+		case <-sync:
+			hook.spool.mu.Lock()
+			err := hook.spool.sync()
+			hook.spool.mu.Unlock()
+			if err != nil {
+				hook.handleError(fmt.Errorf("can't sync spool: %w", err), nil)
+			}
+		case <-replay.C:
+			w := hook.Writer()
+			if w == nil || hook.spool.empty() {
+				continue
+			}
+			// Replay errors are expected while Graylog can't be reached,
+			// and are retried on the next tick.
+			hook.spool.replay(w)
+		}
+	}
+}
+
+// lose keeps a message which couldn't be sent in the spool of the hook,
+// or passes it to the error handler if the hook has no spool.
+func (hook *GraylogHook) lose(err error, m *Message) {
+	err, m = unwrapMessageError(err, m)
+	if hook.spool == nil || m == nil {
+		hook.handleError(err, m)
+		return
+	}
+
+	removed, serr := hook.spool.append(m)
+	for _, path := range removed {
+		hook.handleError(fmt.Errorf("%w, removed %s", ErrSpoolLimit, path), nil)
+	}
+	if serr != nil {
+		hook.handleError(fmt.Errorf("%w (spool: %s)", err, serr), m)
+		return
+	}
+	atomic.AddUint64(&hook.stats.spooled, 1)
+}
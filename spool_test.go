@@ -0,0 +1,222 @@
+package graylog
+
+import (
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// toggleWriter is a GELFWriter which fails while down is set, and records
+// the messages written otherwise.
+type toggleWriter struct {
+	mu       sync.Mutex
+	down     bool
+	messages []string
+}
+
+func (w *toggleWriter) WriteMessage(m *Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.down {
+		return errWriteFailed
+	}
+	w.messages = append(w.messages, m.Short)
+	return nil
+}
+
+func (w *toggleWriter) setDown(down bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.down = down
+}
+
+func (w *toggleWriter) written() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]string(nil), w.messages...)
+}
+
+func TestSpool(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	dir := t.TempDir()
+	hook, err := New(r.Addr(),
+		WithSpool(SpoolConfig{Dir: dir, Sync: SyncAlways, ReplayInterval: 10 * time.Millisecond}),
+		WithErrorHandler(func(err error, m *Message, transport string) {
+			t.Errorf("spooled messages should not be reported, got %s", err)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	defer hook.Close()
+	w := &toggleWriter{down: true}
+	hook.setWriter(w)
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	for _, short := range []string{"first", "second", "third"} {
+		log.Info(short)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 segment, got %d", len(entries))
+	}
+
+	w.setDown(false)
+	deadline := time.Now().Add(time.Second)
+	for len(w.written()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := w.written()
+	if len(got) != 3 || got[0] != "first" || got[1] != "second" || got[2] != "third" {
+		t.Fatalf("expected the spooled messages in order, got %v", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("replayed segments should be removed, got %d", len(entries))
+	}
+}
+
+func TestSpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(SpoolConfig{Dir: dir, MaxSegmentSize: 1})
+	if err != nil {
+		t.Fatalf("openSpool: %s", err)
+	}
+	for _, short := range []string{"first", "second"} {
+		if _, err := s.append(&Message{Version: "1.1", Short: short}); err != nil {
+			t.Fatalf("append: %s", err)
+		}
+	}
+	if err := s.close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	// A new process replays the segments left by the previous one
+	s, err = openSpool(SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("openSpool: %s", err)
+	}
+	if _, err := s.append(&Message{Version: "1.1", Short: "third"}); err != nil {
+		t.Fatalf("append: %s", err)
+	}
+
+	w := &toggleWriter{down: true}
+	if err := s.replay(w); err != errWriteFailed {
+		t.Errorf("replay: expected errWriteFailed, got %v", err)
+	}
+	w.setDown(false)
+	if err := s.replay(w); err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+	got := w.written()
+	if len(got) != 3 || got[0] != "first" || got[1] != "second" || got[2] != "third" {
+		t.Errorf("expected the spooled messages in order, got %v", got)
+	}
+	if !s.empty() {
+		t.Error("spool should be empty")
+	}
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(SpoolConfig{Dir: dir, MaxSegmentSize: 1, MaxSize: 1})
+	if err != nil {
+		t.Fatalf("openSpool: %s", err)
+	}
+	var removed []string
+	for _, short := range []string{"first", "second", "third"} {
+		r, err := s.append(&Message{Version: "1.1", Short: short})
+		if err != nil {
+			t.Fatalf("append: %s", err)
+		}
+		removed = append(removed, r...)
+	}
+	if len(removed) != 2 {
+		t.Fatalf("expected 2 removed segments, got %v", removed)
+	}
+
+	w := &toggleWriter{}
+	if err := s.replay(w); err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+	if got := w.written(); len(got) != 1 || got[0] != "third" {
+		t.Errorf("expected only the last message, got %v", got)
+	}
+}
+
+func TestSpoolMaxSizeDefaultSegments(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(SpoolConfig{Dir: dir, MaxSize: 1000})
+	if err != nil {
+		t.Fatalf("openSpool: %s", err)
+	}
+	var removed []string
+	for i := 0; i < 200; i++ {
+		r, err := s.append(&Message{Version: "1.1", Short: "spooled while Graylog is down"})
+		if err != nil {
+			t.Fatalf("append: %s", err)
+		}
+		removed = append(removed, r...)
+	}
+	if len(removed) == 0 {
+		t.Error("expected segments to be removed")
+	}
+
+	var size int64
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %s", err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatalf("Info: %s", err)
+		}
+		size += info.Size()
+	}
+	if size > 1000 {
+		t.Errorf("expected at most 1000 bytes spooled, got %d", size)
+	}
+}
+
+func TestSpoolMaxAgeActiveSegment(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSpool(SpoolConfig{Dir: dir, MaxAge: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("openSpool: %s", err)
+	}
+	if _, err := s.append(&Message{Version: "1.1", Short: "old"}); err != nil {
+		t.Fatalf("append: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	removed, err := s.append(&Message{Version: "1.1", Short: "new"})
+	if err != nil {
+		t.Fatalf("append: %s", err)
+	}
+	if len(removed) != 1 {
+		t.Errorf("expected the old segment to be removed, got %v", removed)
+	}
+
+	w := &toggleWriter{}
+	if err := s.replay(w); err != nil {
+		t.Fatalf("replay: %s", err)
+	}
+	if got := w.written(); len(got) != 1 || got[0] != "new" {
+		t.Errorf("expected only the new message, got %v", got)
+	}
+}
@@ -0,0 +1,131 @@
+package graylog
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// WriterStats is a snapshot of the counters of a writer.
+type WriterStats struct {
+	Messages        uint64 `json:"messages"`         // messages written
+	Errors          uint64 `json:"errors"`           // messages which couldn't be written
+	Bytes           uint64 `json:"bytes"`            // size of the messages before compression
+	CompressedBytes uint64 `json:"compressed_bytes"` // size of the messages as sent
+	Chunks          uint64 `json:"chunks"`           // chunks sent for messages too large for a datagram
+	Retries         uint64 `json:"retries"`          // messages written again after a failure
+	Reconnects      uint64 `json:"reconnects"`       // connections reestablished
+}
+
+// writerCounters holds the counters of a writer, accessed atomically.
+type writerCounters struct {
+	messages        uint64
+	errors          uint64
+	bytes           uint64
+	compressedBytes uint64
+	chunks          uint64
+	retries         uint64
+	reconnects      uint64
+}
+
+func (c *writerCounters) snapshot() WriterStats {
+	return WriterStats{
+		Messages:        atomic.LoadUint64(&c.messages),
+		Errors:          atomic.LoadUint64(&c.errors),
+		Bytes:           atomic.LoadUint64(&c.bytes),
+		CompressedBytes: atomic.LoadUint64(&c.compressedBytes),
+		Chunks:          atomic.LoadUint64(&c.chunks),
+		Retries:         atomic.LoadUint64(&c.retries),
+		Reconnects:      atomic.LoadUint64(&c.reconnects),
+	}
+}
+
+// count accounts for a message written, or not, by the writer.
+func (c *writerCounters) count(err error) {
+	if err != nil {
+		atomic.AddUint64(&c.errors, 1)
+	} else {
+		atomic.AddUint64(&c.messages, 1)
+	}
+}
+
+// HookStats is a snapshot of the counters of a hook.
+type HookStats struct {
+	Fired          uint64            `json:"fired"`            // entries fired
+	Sent           uint64            `json:"sent"`             // messages written
+	Failed         uint64            `json:"failed"`           // messages which couldn't be written
+	Dropped        uint64            `json:"dropped"`          // entries dropped because the queue was full
+	Spooled        uint64            `json:"spooled"`          // messages kept in the disk spool
+	Errors         map[string]uint64 `json:"errors"`           // errors by transport
+	QueueDepth     int               `json:"queue_depth"`      // entries in the queue
+	QueueHighWater int               `json:"queue_high_water"` // highest queue depth seen
+	Writer         *WriterStats      `json:"writer,omitempty"` // counters of the writer, if it has any
+}
+
+// hookCounters holds the counters of a hook, accessed atomically.
+type hookCounters struct {
+	fired     uint64
+	sent      uint64
+	failed    uint64
+	spooled   uint64
+	highWater int64
+
+	mu     sync.Mutex
+	errors map[string]uint64
+}
+
+func (c *hookCounters) countError(transport string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.errors == nil {
+		c.errors = make(map[string]uint64)
+	}
+	c.errors[transport]++
+}
+
+// observeDepth records a queue depth, for the high-water mark.
+func (c *hookCounters) observeDepth(depth int) {
+	for {
+		high := atomic.LoadInt64(&c.highWater)
+		if int64(depth) <= high || atomic.CompareAndSwapInt64(&c.highWater, high, int64(depth)) {
+			return
+		}
+	}
+}
+
+// Stats returns a snapshot of the counters of the hook, and of its writer
+// if it has a Stats method.
+func (hook *GraylogHook) Stats() HookStats {
+	stats := HookStats{
+		Fired:          atomic.LoadUint64(&hook.stats.fired),
+		Sent:           atomic.LoadUint64(&hook.stats.sent),
+		Failed:         atomic.LoadUint64(&hook.stats.failed),
+		Dropped:        hook.Dropped(),
+		Spooled:        atomic.LoadUint64(&hook.stats.spooled),
+		Errors:         make(map[string]uint64),
+		QueueDepth:     hook.depth(),
+		QueueHighWater: int(atomic.LoadInt64(&hook.stats.highWater)),
+	}
+
+	hook.stats.mu.Lock()
+	for transport, n := range hook.stats.errors {
+		stats.Errors[transport] = n
+	}
+	hook.stats.mu.Unlock()
+
+	if w, ok := hook.Writer().(interface{ Stats() WriterStats }); ok {
+		writerStats := w.Stats()
+		stats.Writer = &writerStats
+	}
+	return stats
+}
+
+// PublishExpvar publishes the stats of the hook as an expvar variable, so
+// that they are served on /debug/vars. Like expvar.Publish, it panics if
+// the name is already used.
+func (hook *GraylogHook) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return hook.Stats()
+	}))
+}
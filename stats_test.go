@@ -0,0 +1,127 @@
+package graylog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestStats(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook, err := New(r.Addr())
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Info("small")
+	if _, err := r.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+	// Random data doesn't compress well, and needs several chunks
+	random := make([]byte, 2*ChunkSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatalf("rand.Read: %s", err)
+	}
+	large := hex.EncodeToString(random)
+	log.Info(large)
+	if _, err := r.ReadMessage(); err != nil {
+		t.Fatalf("ReadMessage: %s", err)
+	}
+
+	stats := hook.Stats()
+	if stats.Fired != 2 || stats.Sent != 2 || stats.Failed != 0 {
+		t.Errorf("unexpected hook stats %+v", stats)
+	}
+	if stats.Writer == nil {
+		t.Fatal("writer stats should be included")
+	}
+	if stats.Writer.Messages != 2 || stats.Writer.Errors != 0 {
+		t.Errorf("unexpected writer stats %+v", stats.Writer)
+	}
+	if stats.Writer.Chunks < 2 {
+		t.Errorf("expected the large message to be chunked, got %d chunks", stats.Writer.Chunks)
+	}
+	if stats.Writer.Bytes < uint64(len(large)) || stats.Writer.CompressedBytes == 0 {
+		t.Errorf("unexpected writer sizes %+v", stats.Writer)
+	}
+
+	hook.setWriter(failingWriter{})
+	hook.ErrorHandler = func(error, *Message, string) {}
+	log.Info("lost")
+	stats = hook.Stats()
+	if stats.Failed != 1 || stats.Errors["failing"] != 1 {
+		t.Errorf("expected 1 error for the failing transport, got %+v", stats)
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook, err := New(r.Addr(), WithQueue(QueueConfig{Size: 4}))
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	w := &blockingWriter{release: make(chan struct{}), received: make(chan *Message, 4)}
+	hook.setWriter(w)
+
+	log := logrus.New()
+	log.Out = io.Discard
+	log.Hooks.Add(hook)
+	log.Info("first")
+	<-w.received
+	log.Info("second")
+	log.Info("third")
+
+	stats := hook.Stats()
+	if stats.QueueDepth != 2 || stats.QueueHighWater != 2 {
+		t.Errorf("expected a queue depth of 2, got %+v", stats)
+	}
+	close(w.release)
+	hook.Close()
+	if stats := hook.Stats(); stats.QueueDepth != 0 || stats.QueueHighWater != 2 {
+		t.Errorf("expected an empty queue, got %+v", stats)
+	}
+}
+
+func TestPublishExpvar(t *testing.T) {
+	r, err := NewUDPReader("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewUDPReader: %s", err)
+	}
+	hook, err := New(r.Addr())
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	// expvar names can't be reused, even when tests are run several times
+	name := fmt.Sprintf("graylog_test_%p", hook)
+	hook.PublishExpvar(name)
+
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatal("stats should be published")
+	}
+	var stats map[string]interface{}
+	if err := json.Unmarshal([]byte(v.String()), &stats); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	for _, key := range []string{"fired", "sent", "queue_high_water", "writer"} {
+		if _, ok := stats[key]; !ok {
+			t.Errorf("%s missing from %s", key, strings.TrimSpace(v.String()))
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package graylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// TruncatePolicy tells what UDP writers do with the messages which would
+// need more than 128 chunks, the maximum accepted by Graylog.
+type TruncatePolicy int
+
+const (
+	// TruncateMessage shortens the full message first, then the largest
+	// extra fields, then drops the stack trace, until the message fits.
+	// Truncated messages have the TruncatedKey field set to true.
+	TruncateMessage TruncatePolicy = iota
+	// TruncateNone fails to write the messages which don't fit.
+	TruncateNone
+)
+
+// TruncatedKey is the field set on messages truncated to fit in 128 chunks.
+const TruncatedKey = "_truncated"
+
+// maxTruncations bounds the number of times a message is shortened before
+// giving up on making it fit.
+const maxTruncations = 16
+
+// truncate shortens a copy of m until its compressed encoding fits in
+// maxChunks chunks, and returns that encoding.
+// mBytes and zBytes are the encoding of m, before and after compression.
+func (w *LowLevelProtocolWriter) truncate(m *Message, mBytes, zBytes []byte) ([]byte, error) {
+	limit := maxChunks * (w.chunkSize() - chunkedHeaderLen)
+
+	t := newTruncation(m)
+	for i := 0; i < maxTruncations && len(zBytes) > limit; i++ {
+		// Assume the compression ratio stays the same, and remove 10%
+		// more to converge quickly.
+		excess := len(mBytes) - len(mBytes)*limit/len(zBytes)
+		if !t.shorten(excess + excess/10 + 1) {
+			break
+		}
+
+		var err error
+		if mBytes, err = json.Marshal(t.m); err != nil {
+			return nil, err
+		}
+		if zBytes, err = w.compress(mBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(zBytes) > limit {
+		return nil, fmt.Errorf("msg too large, would need %d chunks", numChunks(zBytes, w.chunkSize()))
+	}
+	return zBytes, nil
+}
+
+// truncation is a copy of a message being shortened.
+type truncation struct {
+	m *Message
+}
+
+func newTruncation(m *Message) *truncation {
+	c := *m
+	c.Extra = make(map[string]interface{}, len(m.Extra)+1)
+	for k, v := range m.Extra {
+		c.Extra[k] = v
+	}
+	c.Extra[TruncatedKey] = true
+	return &truncation{&c}
+}
+
+// shorten removes about n bytes from the message, and reports whether
+// anything could be removed.
+func (t *truncation) shorten(n int) bool {
+	if t.m.Full != "" {
+		t.m.Full = truncateString(t.m.Full, len(t.m.Full)-n)
+		return true
+	}
+
+	if t.shortenExtra(n) {
+		return true
+	}
+
+	if _, ok := t.m.Extra[StackTraceKey]; ok {
+		delete(t.m.Extra, StackTraceKey)
+		return true
+	}
+
+	if t.m.Short != "" {
+		t.m.Short = truncateString(t.m.Short, len(t.m.Short)-n)
+		return true
+	}
+	return false
+}
+
+// minTruncatedExtra is the size under which extra fields are kept
+// untouched, as they can't make a significant difference.
+const minTruncatedExtra = 256
+
+// shortenExtra removes about n bytes from the largest extra fields, other
+// than the stack trace. String fields are shortened, other ones are
+// removed.
+func (t *truncation) shortenExtra(n int) bool {
+	type field struct {
+		key  string
+		size int
+	}
+	var fields []field
+	for k, v := range t.m.Extra {
+		if k == StackTraceKey || k == TruncatedKey {
+			continue
+		}
+		size := 0
+		if s, ok := v.(string); ok {
+			size = len(s)
+		} else if b, err := json.Marshal(v); err == nil {
+			size = len(b)
+		}
+		if size >= minTruncatedExtra {
+			fields = append(fields, field{k, size})
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		if fields[i].size != fields[j].size {
+			return fields[i].size > fields[j].size
+		}
+		return fields[i].key < fields[j].key
+	})
+
+	for _, f := range fields {
+		if n <= 0 {
+			break
+		}
+		if s, ok := t.m.Extra[f.key].(string); ok && f.size-n >= minTruncatedExtra {
+			t.m.Extra[f.key] = truncateString(s, f.size-n)
+		} else {
+			delete(t.m.Extra, f.key)
+		}
+		n -= f.size
+	}
+	return len(fields) > 0
+}
+
+// truncateString returns the longest prefix of s of at most n bytes which
+// doesn't split a UTF-8 sequence.
+func truncateString(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if n >= len(s) {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
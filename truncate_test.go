@@ -0,0 +1,131 @@
+package graylog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// randomString returns a string of n hexadecimal digits, which doesn't
+// compress well.
+func randomString(t *testing.T, n int) string {
+	b := make([]byte, n/2)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("rand.Read: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func TestTruncation(t *testing.T) {
+	const chunkSize = 200
+	limit := maxChunks * (chunkSize - chunkedHeaderLen)
+
+	tests := []struct {
+		name  string
+		m     *Message
+		check func(t *testing.T, msg *Message)
+	}{
+		{
+			name: "full message",
+			m:    &Message{Version: "1.1", Short: "short", Full: randomString(t, 4*limit)},
+			check: func(t *testing.T, msg *Message) {
+				if msg.Full == "" || len(msg.Full) >= 4*limit {
+					t.Errorf("msg.Full should be shortened, got %d bytes", len(msg.Full))
+				}
+			},
+		},
+		{
+			name: "extra fields",
+			m: &Message{Version: "1.1", Short: "short", Extra: map[string]interface{}{
+				"_large":       randomString(t, 4*limit),
+				"_small":       "kept",
+				StackTraceKey:  randomString(t, limit/4),
+				"_list":        []string{randomString(t, limit/8)},
+				"_other_large": randomString(t, limit/2),
+			}},
+			check: func(t *testing.T, msg *Message) {
+				if msg.Extra["_small"] != "kept" {
+					t.Error("small extra fields should be kept")
+				}
+				if _, ok := msg.Extra[StackTraceKey]; !ok {
+					t.Error("the stack trace should be kept when shortening extra fields is enough")
+				}
+				if large, _ := msg.Extra["_large"].(string); len(large) >= 4*limit {
+					t.Errorf("_large should be shortened, got %d bytes", len(large))
+				}
+			},
+		},
+		{
+			name: "stack trace",
+			m: &Message{Version: "1.1", Short: "short", Extra: map[string]interface{}{
+				"_small":      "kept",
+				StackTraceKey: randomString(t, 4*limit),
+			}},
+			check: func(t *testing.T, msg *Message) {
+				if _, ok := msg.Extra[StackTraceKey]; ok {
+					t.Error("the stack trace should be dropped")
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		r, err := NewUDPReader("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("NewUDPReader: %s", err)
+		}
+		r.ChunkSize = chunkSize
+		w, err := NewWriter(r.Addr(), WithChunkSize(chunkSize))
+		if err != nil {
+			t.Fatalf("NewWriter: %s", err)
+		}
+		if err := w.WriteMessage(test.m); err != nil {
+			t.Fatalf("%s: WriteMessage: %s", test.name, err)
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Fatalf("%s: ReadMessage: %s", test.name, err)
+		}
+		if msg.Short != "short" {
+			t.Errorf("%s: msg.Short should be kept, got %s", test.name, msg.Short)
+		}
+		if msg.Extra[TruncatedKey] != true {
+			t.Errorf("%s: %s should be set", test.name, TruncatedKey)
+		}
+		if _, ok := test.m.Extra[TruncatedKey]; ok {
+			t.Errorf("%s: the original message should not be modified", test.name)
+		}
+		test.check(t, msg)
+	}
+}
+
+func TestTruncateNone(t *testing.T) {
+	w, err := NewWriter("127.0.0.1:12201", WithChunkSize(200), WithTruncation(TruncateNone))
+	if err != nil {
+		t.Fatalf("NewWriter: %s", err)
+	}
+	err = w.WriteMessage(&Message{Version: "1.1", Short: "short", Full: randomString(t, 64*1024)})
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("WriteMessage: expected a too large error, got %v", err)
+	}
+}
+
+func TestTruncateString(t *testing.T) {
+	tests := []struct {
+		s        string
+		n        int
+		expected string
+	}{
+		{"abc", 5, "abc"},
+		{"abc", 2, "ab"},
+		{"abc", -1, ""},
+		{"aé", 2, "a"},
+		{"aé", 3, "aé"},
+	}
+	for _, test := range tests {
+		if got := truncateString(test.s, test.n); got != test.expected {
+			t.Errorf("truncateString(%q, %d): expected %q, got %q", test.s, test.n, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package graylog
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// WriterOption configures a writer created by NewWriter.
+type WriterOption func(*writerConfig)
+
+// writerConfig holds the settings collected from WriterOptions.
+type writerConfig struct {
+	tlsConfig   *tls.Config
+	compression *compression
+	chunkSize   int
+	truncation  TruncatePolicy
+
+	httpHeader     http.Header
+	httpHeaderFunc func(http.Header) error
+	httpClient     *http.Client
+	roundTripper   http.RoundTripper
+	proxy          func(*http.Request) (*url.URL, error)
+	httpTimeout    time.Duration
+	httpTimeoutSet bool
+	batch          *BatchConfig
+
+	cooldown  time.Duration
+	hashField string
+
+	resolveInterval    time.Duration
+	resolveAfterErrors int
+	resolver           *net.Resolver
+
+	dialTimeout     time.Duration
+	dialTimeoutSet  bool
+	writeTimeout    time.Duration
+	writeTimeoutSet bool
+	keepAlive       time.Duration
+}
+
+type compression struct {
+	compressionType CompressType
+	level           int
+}
+
+func newWriterConfig(opts []WriterOption) *writerConfig {
+	c := new(writerConfig)
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithTLSConfig sets the TLS configuration of tls:// writers, and of
+// https:// writers using the default HTTP client. Use it to
+// trust a private CA bundle (RootCAs), to present a client certificate
+// (Certificates), to override the server name checked against the
+// server certificate (ServerName), or to raise the minimum TLS version
+// (MinVersion).
+// The configuration is cloned, and defaults to a TLS 1.2 minimum.
+func WithTLSConfig(config *tls.Config) WriterOption {
+	return func(c *writerConfig) {
+		c.tlsConfig = config.Clone()
+	}
+}
+
+// WithChunkSize sets the size of the datagrams sent by UDP writers, from
+// which messages are chunked. It should be less than the MTU of the path to
+// Graylog minus the IP and UDP headers, see ChunkSizeWAN and ChunkSizeLAN.
+func WithChunkSize(size int) WriterOption {
+	return func(c *writerConfig) {
+		c.chunkSize = size
+	}
+}
+
+// WithTruncation sets what UDP writers do with the messages which would
+// need more than 128 chunks. Defaults to TruncateMessage.
+func WithTruncation(policy TruncatePolicy) WriterOption {
+	return func(c *writerConfig) {
+		c.truncation = policy
+	}
+}
+
+// WithHTTPHeader adds a header to the requests of HTTP writers. It can be
+// used several times, and several times with the same key.
+func WithHTTPHeader(key, value string) WriterOption {
+	return func(c *writerConfig) {
+		if c.httpHeader == nil {
+			c.httpHeader = make(http.Header)
+		}
+		c.httpHeader.Add(key, value)
+	}
+}
+
+// WithHTTPHeaderFunc sets a function called before every request of HTTP
+// writers, to set headers which change over time, such as short-lived
+// tokens. The request fails with the error returned by f, if any.
+func WithHTTPHeaderFunc(f func(header http.Header) error) WriterOption {
+	return func(c *writerConfig) {
+		c.httpHeaderFunc = f
+	}
+}
+
+// WithBasicAuth authenticates the requests of HTTP writers with the
+// given user name and password.
+func WithBasicAuth(username, password string) WriterOption {
+	credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return setHTTPHeader("Authorization", "Basic "+credentials)
+}
+
+// WithBearerToken authenticates the requests of HTTP writers with the
+// given bearer token. Use WithHTTPHeaderFunc for tokens which expire.
+func WithBearerToken(token string) WriterOption {
+	return setHTTPHeader("Authorization", "Bearer "+token)
+}
+
+func setHTTPHeader(key, value string) WriterOption {
+	return func(c *writerConfig) {
+		if c.httpHeader == nil {
+			c.httpHeader = make(http.Header)
+		}
+		c.httpHeader.Set(key, value)
+	}
+}
+
+// WithHTTPClient sets the client used by HTTP writers, for instance an
+// instrumented one. The client isn't modified: WithRoundTripper and
+// WithHTTPTimeout apply to a copy of it, and WithProxy is ignored.
+func WithHTTPClient(client *http.Client) WriterOption {
+	return func(c *writerConfig) {
+		c.httpClient = client
+	}
+}
+
+// WithRoundTripper sets the transport of the client used by HTTP writers.
+// WithProxy is ignored when a transport is set.
+func WithRoundTripper(rt http.RoundTripper) WriterOption {
+	return func(c *writerConfig) {
+		c.roundTripper = rt
+	}
+}
+
+// WithProxy sets the proxy of the default transport of HTTP writers, see
+// http.Transport.Proxy. Requests aren't proxied by default, use
+// http.ProxyFromEnvironment to follow the HTTP_PROXY environment
+// variables.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) WriterOption {
+	return func(c *writerConfig) {
+		c.proxy = proxy
+	}
+}
+
+// WithHTTPTimeout sets the time limit of the requests of HTTP writers,
+// including reading the response. Defaults to 10 seconds, 0 means no limit.
+func WithHTTPTimeout(timeout time.Duration) WriterOption {
+	return func(c *writerConfig) {
+		c.httpTimeout = timeout
+		c.httpTimeoutSet = true
+	}
+}
+
+// WithHTTPBatch makes HTTP writers send messages in batches, see
+// BatchConfig.
+func WithHTTPBatch(config BatchConfig) WriterOption {
+	return func(c *writerConfig) {
+		c.batch = &config
+	}
+}
+
+// WithCooldown sets how long failover and balancing writers leave a
+// failing endpoint aside. Defaults to DefaultCooldown.
+func WithCooldown(cooldown time.Duration) WriterOption {
+	return func(c *writerConfig) {
+		c.cooldown = cooldown
+	}
+}
+
+// WithHashField makes balancing writers select the endpoint of a message
+// by the value of the given extra field, instead of in turn.
+func WithHashField(field string) WriterOption {
+	return func(c *writerConfig) {
+		c.hashField = field
+	}
+}
+
+// WithResolveInterval makes UDP writers resolve the host name of Graylog
+// again at the given interval, so that they follow its address when it
+// changes. The address is resolved once by default.
+func WithResolveInterval(interval time.Duration) WriterOption {
+	return func(c *writerConfig) {
+		c.resolveInterval = interval
+	}
+}
+
+// WithResolveAfterErrors makes UDP writers resolve the host name of
+// Graylog again after the given number of consecutive failed writes.
+func WithResolveAfterErrors(errors int) WriterOption {
+	return func(c *writerConfig) {
+		c.resolveAfterErrors = errors
+	}
+}
+
+// WithResolver sets the resolver used by UDP, TCP and TLS writers to look
+// up the host name of Graylog, such as a resolver querying a given DNS
+// server. Defaults to net.DefaultResolver.
+func WithResolver(resolver *net.Resolver) WriterOption {
+	return func(c *writerConfig) {
+		c.resolver = resolver
+	}
+}
+
+// WithDialTimeout bounds the time taken by UDP, TCP, TLS and Unix socket
+// writers to connect to Graylog, including the TLS handshake. Defaults to
+// DefaultDialTimeout, 0 means no limit.
+func WithDialTimeout(timeout time.Duration) WriterOption {
+	return func(c *writerConfig) {
+		c.dialTimeout = timeout
+		c.dialTimeoutSet = true
+	}
+}
+
+// WithWriteTimeout bounds the time taken by UDP, TCP, TLS and Unix socket
+// writers to write a message, and to redial broken connections.
+// Connections timing out are redialed.
+// Defaults to DefaultWriteTimeout, 0 means no limit.
+func WithWriteTimeout(timeout time.Duration) WriterOption {
+	return func(c *writerConfig) {
+		c.writeTimeout = timeout
+		c.writeTimeoutSet = true
+	}
+}
+
+// WithKeepAlive sets the interval between the keep-alive probes of TCP
+// and TLS writers, see net.Dialer.KeepAlive. Keep-alive probes are sent
+// every 15 seconds by default, and disabled by a negative interval.
+func WithKeepAlive(interval time.Duration) WriterOption {
+	return func(c *writerConfig) {
+		c.keepAlive = interval
+	}
+}